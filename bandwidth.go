@@ -0,0 +1,216 @@
+package ratelimit
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Units of the bandwidth rates, ie. Rate(ratelimit.MiB, time.Second).
+// A single token allows to transfer a single byte.
+const (
+	KiB = 1024
+	MiB = 1024 * KiB
+	GiB = 1024 * MiB
+)
+
+// defaultChunk is the default number of bytes worth waiting for.
+const defaultChunk = 32 * KiB
+
+// tokens tracks tokens of a bucket, as of the last take.
+type tokens struct {
+	left int       // tokens left in the bucket
+	next time.Time // time the bucket gains its next token
+}
+
+// update updates the tokens by result of taking n tokens from a bucket
+// of a given limit.
+func (t *tokens) update(result TakeResult, limit Limit, n int) {
+	t.left, t.next = result.Remaining, result.Reset
+	if !result.Taken {
+		// The bucket holds fewer than n tokens and gains the n-th one
+		// at the reset, so the next one comes sooner.
+		interval := float64(limit.Window) / float64(limit.Rate)
+		t.next = result.Reset.Add(-time.Duration(float64(n-t.left-1) * interval))
+	}
+}
+
+// wait waits until the bucket holds n tokens, as estimated from the refill
+// rate of a given limit. It returns false if ctx was done in the meantime.
+func (t *tokens) wait(ctx context.Context, limit Limit, n int) bool {
+	if t.left >= n {
+		return true
+	}
+	interval := float64(limit.Window) / float64(limit.Rate)
+	at := t.next.Add(time.Duration(float64(n-t.left-1) * interval))
+	return sleep(ctx, at.Sub(time.Now()))
+}
+
+// pacer reserves bytes to transfer from a token bucket, paced by the refill
+// rate of the bucket. It's shared by the download and upload limiters.
+type pacer struct {
+	ctx            context.Context
+	store          TokenBucketStore
+	fallbackStores []TokenBucketStore
+	key            string
+	limit          Limit
+	chunk          int
+
+	shared *sharedBucket // optional
+
+	reserved int // bytes allowed to transfer
+	tokens   tokens
+}
+
+func newPacer(ctx context.Context, store TokenBucketStore, fallbackStores []TokenBucketStore, key string, limit Limit, chunk int, shared *sharedBucket) pacer {
+	return pacer{
+		ctx:            ctx,
+		store:          store,
+		fallbackStores: fallbackStores,
+		key:            key,
+		limit:          limit,
+		chunk:          chunk,
+		shared:         shared,
+		tokens:         tokens{left: limit.Burst},
+	}
+}
+
+// sharedBucket is a bucket shared by all of the transfers, on top of their
+// own buckets. The transfers take their turns to take its tokens in FIFO
+// order, so the new ones aren't starved by the existing ones. The order
+// is kept within a single process, while the bucket itself is kept in
+// the store.
+type sharedBucket struct {
+	key    string
+	limit  Limit
+	turn   chan struct{}
+	active int32 // number of transfers, accessed atomically
+
+	tokens tokens // guarded by the turn
+}
+
+func newSharedBucket(key string, limit Limit) *sharedBucket {
+	return &sharedBucket{
+		key:    key,
+		limit:  limit,
+		turn:   make(chan struct{}, 1),
+		tokens: tokens{left: limit.Burst},
+	}
+}
+
+// start counts a new transfer and returns function to call once it's done.
+func (b *sharedBucket) start() func() {
+	atomic.AddInt32(&b.active, 1)
+	return func() {
+		atomic.AddInt32(&b.active, -1)
+	}
+}
+
+// share returns the number of tokens a transfer may take in its turn,
+// ie. a fair share of the bucket among all of the transfers.
+func (b *sharedBucket) share() int {
+	active := int(atomic.LoadInt32(&b.active))
+	if active < 1 {
+		active = 1
+	}
+	return b.limit.Burst / active
+}
+
+// reserve waits until it's allowed to transfer some of the want bytes
+// and returns how many. The caller must release the bytes transferred.
+func (p *pacer) reserve(want int) (int, error) {
+	for p.reserved == 0 {
+		// Take tokens for all of the bytes at once, but no more than left
+		// in the bucket, so the transfer is paced by the refill rate rather
+		// than done in bursts of whole buckets. Wait for a whole chunk at
+		// least, unless there are fewer bytes to transfer.
+		n := want
+		if n > p.limit.Burst {
+			n = p.limit.Burst
+		}
+		need := n
+		if need > p.chunk {
+			need = p.chunk
+		}
+		if !p.tokens.wait(p.ctx, p.limit, need) {
+			return 0, p.ctx.Err()
+		}
+		if n > p.tokens.left {
+			n = p.tokens.left
+		}
+		if n < need {
+			n = need
+		}
+
+		if p.shared != nil {
+			taken, err := p.takeShared(n, need)
+			if err != nil {
+				return 0, err
+			}
+			p.reserved += taken
+			continue
+		}
+		ok, remaining, reset, err := take(p.ctx, p.store, p.fallbackStores, p.key, p.limit, n)
+		if err != nil {
+			return 0, err
+		}
+		p.tokens.update(TakeResult{Taken: ok, Remaining: remaining, Reset: reset}, p.limit, n)
+		if ok {
+			p.reserved += n
+		}
+	}
+
+	if want > p.reserved {
+		return p.reserved, nil
+	}
+	return want, nil
+}
+
+// takeShared waits for its turn and takes up to n tokens, but need tokens
+// at least, from both its own and the shared bucket. It returns the number
+// of tokens taken.
+func (p *pacer) takeShared(n int, need int) (int, error) {
+	b := p.shared
+	select {
+	case b.turn <- struct{}{}:
+	case <-p.ctx.Done():
+		return 0, p.ctx.Err()
+	}
+	defer func() { <-b.turn }()
+
+	if need > b.limit.Burst {
+		need = b.limit.Burst
+	}
+	if !b.tokens.wait(p.ctx, b.limit, need) {
+		return 0, p.ctx.Err()
+	}
+	if share := b.share(); n > share {
+		n = share
+	}
+	if n > b.tokens.left {
+		n = b.tokens.left
+	}
+	if n < need {
+		n = need
+	}
+
+	takes := []TakeRequest{
+		{Key: p.key, Limit: p.limit, N: n},
+		{Key: b.key, Limit: b.limit, N: n},
+	}
+	results, err := takeBatch(p.ctx, p.store, p.fallbackStores, takes)
+	if err != nil {
+		return 0, err
+	}
+	p.tokens.update(results[0], p.limit, n)
+	b.tokens.update(results[1], b.limit, n)
+	if !results[0].Taken || !results[1].Taken {
+		return 0, nil
+	}
+	return n, nil
+}
+
+// release marks n of the reserved bytes as transferred.
+func (p *pacer) release(n int) {
+	p.reserved -= n
+}
@@ -15,29 +15,89 @@ type downloadBuilder struct {
 	keyFn  KeyFn
 	rate   int
 	window time.Duration
+	burst  int
+	chunk  int
+	name   string
+	total  Limit
 }
 
+// Rate sets the speed in bytes per window, ie. Rate(ratelimit.MiB, time.Second).
 func (b *downloadBuilder) Rate(rate int, window time.Duration) *downloadBuilder {
 	b.rate = rate
 	b.window = window
 	return b
 }
 
-// TODO: Custom burst?
-// func (b *downloadBuilder) Burst(burst int) *downloadBuilder {}
+// Burst sets the maximum number of bytes a bucket can hold, ie. how far
+// a client can go over the steady rate in a short period of time.
+// Defaults to rate.
+func (b *downloadBuilder) Burst(burst int) *downloadBuilder {
+	b.burst = burst
+	return b
+}
+
+// Chunk sets the number of bytes worth waiting for once the bucket is empty,
+// ie. the granularity of the pacing. Smaller chunks make the transfer smoother
+// at the cost of more calls to the store. Defaults to 32 KiB.
+func (b *downloadBuilder) Chunk(size int) *downloadBuilder {
+	b.chunk = size
+	return b
+}
+
+// Total caps the combined speed of all of the downloads, on top of the speed
+// of each key. The downloads share the total speed fairly, taking their turns
+// in FIFO order, so the new ones aren't starved by the existing ones. The
+// store must implement BatchTokenBucketStore.
+func (b *downloadBuilder) Total(rate int, window time.Duration) *downloadBuilder {
+	if rate <= 0 || window <= 0 {
+		panic("Total expects rate > 0 and window > 0")
+	}
+	b.total = Limit{Rate: rate, Window: window, Burst: rate}
+	return b
+}
+
+// Name sets the namespace of the limiter's buckets in the store. Limiters
+// sharing the store have buckets of their own, unless they have the same
+// name, ie. the same limiter run by multiple processes sharing Redis.
+// Defaults to the function and line calling LimitBy, which match among
+// processes running the same code, but change as the code does.
+func (b *downloadBuilder) Name(name string) *downloadBuilder {
+	b.name = name
+	return b
+}
 
 func (b *downloadBuilder) LimitBy(store TokenBucketStore, fallbackStores ...TokenBucketStore) func(http.Handler) http.Handler {
-	store.InitRate(b.rate, b.window)
-	for _, store := range fallbackStores {
-		store.InitRate(b.rate, b.window)
+	if b.rate <= 0 || b.window <= 0 {
+		panic("LimitBy expects Rate with rate > 0 and window > 0")
+	}
+
+	limit := Limit{Rate: b.rate, Window: b.window, Burst: b.burst}
+	if limit.Burst <= 0 {
+		limit.Burst = limit.Rate
+	}
+	chunk := b.chunk
+	if chunk <= 0 {
+		chunk = defaultChunk
 	}
 
 	downloadLimiter := downloadLimiter{
 		downloadBuilder: b,
+		limit:           limit,
+		chunk:           chunk,
+		namespace:       namespace(b.name),
 		store:           store,
 		fallbackStores:  fallbackStores,
 	}
 
+	if b.total.Rate > 0 {
+		for _, store := range append([]TokenBucketStore{store}, fallbackStores...) {
+			if _, ok := store.(BatchTokenBucketStore); !ok {
+				panic("LimitBy expects BatchTokenBucketStore for Total")
+			}
+		}
+		downloadLimiter.shared = newSharedBucket("download:"+downloadLimiter.namespace+":total:"+b.total.String(), b.total)
+	}
+
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			key := downloadLimiter.keyFn(r)
@@ -46,13 +106,16 @@ func (b *downloadBuilder) LimitBy(store TokenBucketStore, fallbackStores ...Toke
 				return
 			}
 
+			if downloadLimiter.shared != nil {
+				defer downloadLimiter.shared.start()()
+			}
+
 			lw := &limitWriter{
-				ResponseWriter:  w,
-				downloadLimiter: &downloadLimiter,
-				key:             key,
+				ResponseWriter: w,
+				pacer:          downloadLimiter.pacer(r, key),
 			}
 
-			next.ServeHTTP(lw, r)
+			next.ServeHTTP(wrap(lw), r)
 		}
 		return http.HandlerFunc(fn)
 	}
@@ -62,56 +125,46 @@ type downloadLimiter struct {
 	*downloadBuilder
 
 	next           http.Handler
+	limit          Limit
+	chunk          int
+	namespace      string
 	store          TokenBucketStore
 	fallbackStores []TokenBucketStore
+	shared         *sharedBucket
+}
+
+// pacer returns pacer of a given request.
+func (l *downloadLimiter) pacer(r *http.Request, key string) pacer {
+	return newPacer(r.Context(), l.store, l.fallbackStores, "download:"+l.namespace+":"+l.limit.String()+":"+key, l.limit, l.chunk, l.shared)
 }
 
 type limitWriter struct {
 	http.ResponseWriter
-	*downloadLimiter
+	pacer
 
-	key         string
 	wroteHeader bool
-	canWrite    int64
+}
+
+// Unwrap returns the underlying http.ResponseWriter, ie. for
+// http.ResponseController.
+func (w *limitWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 func (w *limitWriter) Write(buf []byte) (int, error) {
 	total := 0
-	for {
-		if w.canWrite < 1024 {
-			ok, _, _, err := w.downloadLimiter.store.Take("download:" + w.key)
-			if err != nil {
-				for _, store := range w.fallbackStores {
-					ok, _, _, err = store.Take("download:" + w.key)
-					if err == nil {
-						break
-					}
-				}
-			}
-			if err != nil {
-				return total, err
-			}
-			if ok {
-				w.canWrite += 1024
-			}
-		}
-		if w.canWrite == 0 {
-			continue
-		}
-
-		max := len(buf) - total
-		if int(w.canWrite) < max {
-			max = int(w.canWrite)
-		}
-		if max == 0 {
-			return total, nil
+	for total < len(buf) {
+		max, err := w.reserve(len(buf) - total)
+		if err != nil {
+			return total, err
 		}
 
 		n, err := w.ResponseWriter.Write(buf[total : total+max])
-		w.canWrite -= int64(n)
+		w.release(n)
 		total += n
 		if err != nil {
 			return total, err
 		}
 	}
+	return total, nil
 }
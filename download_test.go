@@ -1,7 +1,16 @@
 package ratelimit_test
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
 	"time"
 
 	"github.com/VojtechVitek/ratelimit"
@@ -11,7 +20,7 @@ import (
 // Watch the download speed with
 // wget http://localhost:3333/file -q --show-progress
 func ExampleDownloadSpeed() {
-	middleware := ratelimit.DownloadSpeed(ratelimit.IP).Rate(1024, time.Second).LimitBy(memory.New())
+	middleware := ratelimit.DownloadSpeed(ratelimit.IP).Rate(ratelimit.MiB, time.Second).LimitBy(memory.New())
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "/dev/random")
@@ -19,3 +28,201 @@ func ExampleDownloadSpeed() {
 
 	http.ListenAndServe(":3333", middleware(handler))
 }
+
+// Each client downloads at 1 MiB/s at most, while all of them together
+// download at 100 MiB/s at most.
+func ExampleDownloadSpeed_total() {
+	middleware := ratelimit.DownloadSpeed(ratelimit.IP).Rate(ratelimit.MiB, time.Second).Total(100*ratelimit.MiB, time.Second).LimitBy(memory.New())
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "/dev/random")
+	})
+
+	http.ListenAndServe(":3333", middleware(handler))
+}
+
+func TestDownloadSpeedWithoutRate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("LimitBy didn't panic without Rate")
+		}
+	}()
+	ratelimit.DownloadSpeed(ratelimit.IP).LimitBy(memory.New())
+}
+
+// readerFromRecorder records readers passed to ReadFrom.
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	srcs []string
+}
+
+func (w *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if lr, ok := src.(*io.LimitedReader); ok {
+		w.srcs = append(w.srcs, fmt.Sprintf("%T{%T}", lr, lr.R))
+	} else {
+		w.srcs = append(w.srcs, fmt.Sprintf("%T", src))
+	}
+	return io.Copy(w.ResponseRecorder, src)
+}
+
+// takenStore counts tokens taken from the store.
+type takenStore struct {
+	ratelimit.TokenBucketStore
+	taken int
+}
+
+func (s *takenStore) Take(key string, limit ratelimit.Limit, n int) (bool, int, time.Time, error) {
+	taken, remaining, reset, err := s.TokenBucketStore.Take(key, limit, n)
+	if taken {
+		s.taken += n
+	}
+	return taken, remaining, reset, err
+}
+
+func TestDownloadSpeedReadFrom(t *testing.T) {
+	store := &takenStore{TokenBucketStore: memory.New()}
+	middleware := ratelimit.DownloadSpeed(ratelimit.IP).Rate(ratelimit.MiB, time.Second).LimitBy(store)
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(io.ReaderFrom); !ok {
+			t.Fatal("io.ReaderFrom is not preserved")
+		}
+		io.CopyN(w, bytes.NewReader(make([]byte, 1000)), 100)
+	}))
+
+	w := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Body.Len() != 100 {
+		t.Errorf("wrote %d bytes, want 100", w.Body.Len())
+	}
+	if store.taken != 100 {
+		t.Errorf("took %d tokens, want 100", store.taken)
+	}
+	if want := []string{"*io.LimitedReader{*bytes.Reader}"}; !reflect.DeepEqual(w.srcs, want) {
+		t.Errorf("got ReadFrom sources %v, want %v", w.srcs, want)
+	}
+}
+
+// countStore counts calls to the store.
+type countStore struct {
+	ratelimit.TokenBucketStore
+	mu    sync.Mutex
+	calls int
+}
+
+func (s *countStore) Take(key string, limit ratelimit.Limit, n int) (bool, int, time.Time, error) {
+	s.count()
+	return s.TokenBucketStore.Take(key, limit, n)
+}
+
+func (s *countStore) TakeBatch(ctx context.Context, takes []ratelimit.TakeRequest) ([]ratelimit.TakeResult, error) {
+	s.count()
+	return s.TokenBucketStore.(ratelimit.BatchTokenBucketStore).TakeBatch(ctx, takes)
+}
+
+func (s *countStore) count() {
+	s.mu.Lock()
+	s.calls++
+	s.mu.Unlock()
+}
+
+func (s *countStore) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func TestDownloadSpeedSharedKey(t *testing.T) {
+	store := &countStore{TokenBucketStore: memory.New()}
+	middleware := ratelimit.DownloadSpeed(ratelimit.IP).Rate(256*ratelimit.KiB, time.Second).Burst(32 * ratelimit.KiB).Chunk(16 * ratelimit.KiB).LimitBy(store)
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 96*ratelimit.KiB))
+	}))
+
+	// Two downloads share the bucket of the same client, so they have
+	// to wait for the tokens taken by each other.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}()
+	}
+	wg.Wait()
+
+	// 160 KiB over the burst in chunks of 16 KiB, plus the failed takes.
+	if calls := store.Calls(); calls > 40 {
+		t.Errorf("made %d calls to the store, want 40 at most", calls)
+	}
+}
+
+func TestDownloadSpeedPacing(t *testing.T) {
+	store := &countStore{TokenBucketStore: memory.New()}
+	middleware := ratelimit.DownloadSpeed(ratelimit.IP).Rate(256*ratelimit.KiB, time.Second).Burst(32 * ratelimit.KiB).Chunk(16 * ratelimit.KiB).LimitBy(store)
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10; i++ {
+			w.Write(make([]byte, 16*ratelimit.KiB))
+		}
+	}))
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	elapsed := time.Since(start)
+
+	if w.Body.Len() != 160*ratelimit.KiB {
+		t.Errorf("wrote %d bytes, want %d", w.Body.Len(), 160*ratelimit.KiB)
+	}
+	// 128 KiB over the burst at 256 KiB/s.
+	if elapsed < 450*time.Millisecond || elapsed > time.Second {
+		t.Errorf("took %v, want 500ms", elapsed)
+	}
+	// The pacer sleeps until the next chunk, rather than polling the store.
+	if calls := store.Calls(); calls > 20 {
+		t.Errorf("made %d calls to the store, want 20 at most", calls)
+	}
+}
+
+func TestDownloadSpeedTotal(t *testing.T) {
+	middleware := ratelimit.DownloadSpeed(ratelimit.IP).Rate(ratelimit.MiB, time.Second).Total(256*ratelimit.KiB, time.Second).LimitBy(memory.New())
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		w.Write(make([]byte, size))
+	}))
+	download := func(ip string, size int) time.Duration {
+		start := time.Now()
+		r := httptest.NewRequest("GET", fmt.Sprintf("/?size=%d", size), nil)
+		r.RemoteAddr = ip + ":1234"
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		return time.Since(start)
+	}
+
+	// A large download drains the shared bucket, then a small one starts.
+	start := time.Now()
+	var large, small time.Duration
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		large = download("192.0.2.1", 512*ratelimit.KiB)
+	}()
+	go func() {
+		defer wg.Done()
+		time.Sleep(100 * time.Millisecond)
+		small = download("192.0.2.2", 64*ratelimit.KiB)
+	}()
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// 320 KiB over the shared burst at 256 KiB/s, although each client
+	// could download at 1 MiB/s.
+	if elapsed < 1200*time.Millisecond {
+		t.Errorf("took %v, want 1.25s", elapsed)
+	}
+	// The small download gets half of the total speed, rather than waiting
+	// for the large one.
+	if small > 800*time.Millisecond || small > large/2 {
+		t.Errorf("small download took %v, large one %v", small, large)
+	}
+}
@@ -35,7 +35,7 @@ func main() {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 
-	r.Use(ratelimit.DownloadSpeed(ratelimit.IP).Rate(1024, time.Second).LimitBy(redis.New(pool), memory.New()))
+	r.Use(ratelimit.DownloadSpeed(ratelimit.IP).Rate(ratelimit.MiB, time.Second).LimitBy(redis.New(pool), memory.New()))
 	r.Get("/", ServeVideo)
 
 	http.ListenAndServe(":3333", r)
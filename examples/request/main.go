@@ -48,8 +48,4 @@ func Hello(w http.ResponseWriter, r *http.Request) {
 	//w.Write([]byte("Hello user_id=" + r.URL.Query().Get("user_id") + "\n"))
 }
 
-func UserKey(r *http.Request) string {
-	user := r.URL.Query().Get("user_id")
-	// user, _ := r.Context().Value("session.user_id").(string)
-	return user
-}
+var UserKey = ratelimit.Query("user_id")
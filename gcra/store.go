@@ -0,0 +1,60 @@
+// Package gcra implements Generic Cell Rate Algorithm on top of any storage
+// able to keep a single timestamp per key, ie. Redis or In-Memory.
+//
+// GCRA is equivalent to Token Bucket algorithm, but instead of the number
+// of tokens and the time of the last refill, it only keeps the theoretical
+// arrival time (TAT) of the next request. This makes it very cheap to store
+// state of a large number of keys.
+package gcra
+
+import (
+	"math"
+	"time"
+
+	"github.com/VojtechVitek/ratelimit"
+)
+
+// TATStore is an interface for any storage of theoretical arrival times.
+type TATStore interface {
+	// Advance atomically advances the TAT stored under key by increment,
+	// starting at now if the TAT is in the past or there's none, unless
+	// the advanced TAT would get ahead of now by more than tolerance. It
+	// returns the stored TAT and whether it was advanced. The stored TAT
+	// may be dropped once it's in the past.
+	Advance(key string, now time.Time, increment, tolerance time.Duration) (tat time.Time, ok bool, err error)
+}
+
+type bucketStore struct {
+	tats TATStore
+}
+
+// New creates new GCRA store backed by a given TAT store.
+func New(tats TATStore) *bucketStore {
+	return &bucketStore{
+		tats: tats,
+	}
+}
+
+// Take implements TokenBucketStore interface. It takes n tokens from
+// a bucket referenced by a given key, if available.
+func (s *bucketStore) Take(key string, limit ratelimit.Limit, n int) (bool, int, time.Time, error) {
+	// Nanoseconds between two requests at the steady rate and nanoseconds
+	// the TAT can get ahead of the current time.
+	interval := float64(limit.Window) / float64(limit.Rate)
+	increment := time.Duration(float64(n) * interval)
+	tolerance := time.Duration(float64(limit.Burst) * interval)
+
+	now := time.Now()
+	tat, taken, err := s.tats.Advance(key, now, increment, tolerance)
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+	if !taken {
+		return false, 0, tat.Add(increment - tolerance), nil
+	}
+
+	allowAt := tat.Add(-tolerance)
+	remaining := int(math.Floor(float64(now.Sub(allowAt)) / interval))
+	reset := allowAt.Add(time.Duration(float64(remaining+1) * interval))
+	return true, remaining, reset, nil
+}
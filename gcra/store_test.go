@@ -0,0 +1,101 @@
+package gcra_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/VojtechVitek/ratelimit"
+	"github.com/VojtechVitek/ratelimit/gcra"
+	"github.com/VojtechVitek/ratelimit/memory"
+)
+
+func ExampleNew() {
+	store := gcra.New(memory.NewTATStore())
+	middleware := ratelimit.Request(ratelimit.IP).Rate(30, time.Minute).Burst(10).LimitBy(store)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello World!"))
+	})
+
+	http.ListenAndServe(":3333", middleware(handler))
+}
+
+// advanceRecorder records increments and tolerances passed to Advance.
+type advanceRecorder struct {
+	gcra.TATStore
+	increments, tolerances []time.Duration
+}
+
+func (s *advanceRecorder) Advance(key string, now time.Time, increment, tolerance time.Duration) (time.Time, bool, error) {
+	s.increments = append(s.increments, increment)
+	s.tolerances = append(s.tolerances, tolerance)
+	return s.TATStore.Advance(key, now, increment, tolerance)
+}
+
+func TestTake(t *testing.T) {
+	// A token every 100ms, the TAT can get up to 300ms ahead.
+	limit := ratelimit.Limit{Rate: 10, Window: time.Second, Burst: 3}
+
+	tests := []struct {
+		n         int
+		increment time.Duration
+		taken     bool
+		remaining int
+		reset     time.Duration // since the take, rounded to milliseconds
+	}{
+		// More than burst is never taken, nor does it advance the TAT.
+		{n: 4, increment: 400 * time.Millisecond, taken: false, reset: 100 * time.Millisecond},
+		// The whole burst advances the TAT right to the tolerance.
+		{n: 3, increment: 300 * time.Millisecond, taken: true, remaining: 0, reset: 100 * time.Millisecond},
+		{n: 1, increment: 100 * time.Millisecond, taken: false, reset: 100 * time.Millisecond},
+		{n: 2, increment: 200 * time.Millisecond, taken: false, reset: 200 * time.Millisecond},
+	}
+
+	tats := &advanceRecorder{TATStore: memory.NewTATStore()}
+	store := gcra.New(tats)
+	for i, tt := range tests {
+		now := time.Now()
+		taken, remaining, reset, err := store.Take("key", limit, tt.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if taken != tt.taken || remaining != tt.remaining {
+			t.Errorf("%d: got taken %v, remaining %d, want %v, %d", i, taken, remaining, tt.taken, tt.remaining)
+		}
+		if got := reset.Sub(now).Round(10 * time.Millisecond); got != tt.reset {
+			t.Errorf("%d: got reset in %v, want %v", i, got, tt.reset)
+		}
+		if got := tats.increments[i]; got != tt.increment {
+			t.Errorf("%d: got increment %v, want %v", i, got, tt.increment)
+		}
+		if got := tats.tolerances[i]; got != 300*time.Millisecond {
+			t.Errorf("%d: got tolerance %v, want 300ms", i, got)
+		}
+	}
+}
+
+func TestTakeRefill(t *testing.T) {
+	limit := ratelimit.Limit{Rate: 100, Window: time.Second, Burst: 5}
+	store := gcra.New(memory.NewTATStore())
+
+	for i := 0; i < 5; i++ {
+		if taken, _, _, _ := store.Take("key", limit, 1); !taken {
+			t.Fatalf("take %d of burst not taken", i)
+		}
+	}
+	if taken, _, _, _ := store.Take("key", limit, 1); taken {
+		t.Fatal("take over burst taken")
+	}
+
+	// A token is regained every 10ms, but no more than burst. The TAT
+	// in the past counts as now.
+	time.Sleep(100 * time.Millisecond)
+	taken, remaining, _, err := store.Take("key", limit, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !taken || remaining != 4 {
+		t.Errorf("got taken %v, remaining %d, want true, 4", taken, remaining)
+	}
+}
@@ -0,0 +1,48 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// HeaderFormat selects the rate limit headers sent with the responses.
+type HeaderFormat int
+
+const (
+	// LegacyHeaders are the X-RateLimit-* headers.
+	LegacyHeaders HeaderFormat = 1 << iota
+
+	// IETFHeaders are the RateLimit and RateLimit-Policy headers, as defined
+	// by draft-ietf-httpapi-ratelimit-headers.
+	IETFHeaders
+)
+
+// writeHeaders writes headers describing a given status of a given limit
+// in a given format.
+func writeHeaders(h http.Header, format HeaderFormat, status Status, limit Limit) {
+	if format&LegacyHeaders != 0 {
+		h.Set("X-RateLimit-Key", status.Key)
+		h.Set("X-RateLimit-Rate", fmt.Sprintf("%v", float32(float64(limit.Rate)/limit.Window.Seconds())))
+		h.Set("X-RateLimit-Limit", fmt.Sprintf("%d", status.Limit))
+		h.Set("X-RateLimit-Remaining", fmt.Sprintf("%d", status.Remaining))
+		h.Set("X-RateLimit-Reset", fmt.Sprintf("%d", status.Reset.Unix()))
+	}
+	if format&IETFHeaders != 0 {
+		h.Set("RateLimit", fmt.Sprintf("limit=%d, remaining=%d, reset=%d", status.Limit, status.Remaining, seconds(status.Reset.Sub(time.Now()))))
+		policy := fmt.Sprintf("%d;w=%d", limit.Rate, seconds(limit.Window))
+		if limit.Burst != limit.Rate {
+			policy += fmt.Sprintf(";burst=%d", limit.Burst)
+		}
+		h.Set("RateLimit-Policy", policy)
+	}
+}
+
+// seconds returns a given duration in whole seconds, rounded up.
+func seconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(d.Seconds()))
+}
@@ -6,22 +6,161 @@ import (
 	"strings"
 )
 
-// IP returns unique key per request IP.
+// IP returns unique key per request IP. It doesn't look at any headers,
+// which could be spoofed by the client. Use ClientIP behind proxies.
 func IP(r *http.Request) string {
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		if i := strings.IndexAny(xff, ",;"); i != -1 {
-			xff = xff[:i]
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
+// ClientIP returns KeyFn keyed by the client IP, as reported by trusted
+// proxies in X-Forwarded-For header. The header is walked from the right
+// and it stops at the first hop not in the trustedProxies list, so the
+// client can't spoof its IP. The trusted proxies are given as CIDRs or
+// single IPs. It panics on invalid input.
+func ClientIP(trustedProxies ...string) KeyFn {
+	trusted := parseNets(trustedProxies)
+
+	return func(r *http.Request) string {
+		var hops []string
+		for _, xff := range r.Header["X-Forwarded-For"] {
+			hops = append(hops, strings.Split(xff, ",")...)
 		}
-		ip += "," + xff
+		return trusted.client(r, hops)
 	}
-	if xrip := r.Header.Get("X-Real-IP"); xrip != "" {
-		ip += "," + xrip
+}
+
+// ClientIPForwarded is like ClientIP, but it walks RFC 7239 Forwarded
+// header instead of X-Forwarded-For.
+func ClientIPForwarded(trustedProxies ...string) KeyFn {
+	trusted := parseNets(trustedProxies)
+
+	return func(r *http.Request) string {
+		var hops []string
+		for _, fwd := range r.Header["Forwarded"] {
+			for _, elem := range strings.Split(fwd, ",") {
+				hop := ""
+				for _, pair := range strings.Split(elem, ";") {
+					pair = strings.TrimSpace(pair)
+					if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+						hop = pair[4:]
+					}
+				}
+				hops = append(hops, hop)
+			}
+		}
+		return trusted.client(r, hops)
+	}
+}
+
+// ClientIPHeader returns KeyFn keyed by the client IP sent in a single
+// header by a trusted proxy, ie. CF-Connecting-IP or True-Client-IP.
+// The header is ignored unless the request comes from trustedProxies.
+func ClientIPHeader(header string, trustedProxies ...string) KeyFn {
+	trusted := parseNets(trustedProxies)
+
+	return func(r *http.Request) string {
+		ip := IP(r)
+		if !trusted.contains(net.ParseIP(ip)) {
+			return ip
+		}
+		if client := parseHop(r.Header.Get(header)); client != nil {
+			return client.String()
+		}
+		return ip
+	}
+}
+
+// Subnet returns KeyFn keyed by the subnet of the IP returned by keyFn,
+// ie. Subnet(IP, 24, 64). This stops clients from getting new buckets by
+// cycling through the addresses they own, ie. a whole IPv6 /64. Keys that
+// are not IPs are returned as they are. It panics on invalid prefix length.
+func Subnet(keyFn KeyFn, ipv4Prefix int, ipv6Prefix int) KeyFn {
+	if ipv4Prefix < 0 || ipv4Prefix > 32 || ipv6Prefix < 0 || ipv6Prefix > 128 {
+		panic("Subnet expects valid IPv4 and IPv6 prefix length")
+	}
+	ipv4Mask := net.CIDRMask(ipv4Prefix, 32)
+	ipv6Mask := net.CIDRMask(ipv6Prefix, 128)
+
+	return func(r *http.Request) string {
+		key := keyFn(r)
+		ip := net.ParseIP(key)
+		if ip == nil {
+			return key
+		}
+		subnet := net.IPNet{IP: ip.Mask(ipv6Mask), Mask: ipv6Mask}
+		if ip4 := ip.To4(); ip4 != nil {
+			subnet = net.IPNet{IP: ip4.Mask(ipv4Mask), Mask: ipv4Mask}
+		}
+		return subnet.String()
 	}
-	return ip
 }
 
 // NOP returns empty key for each request.
 func NOP(r *http.Request) string {
 	return ""
 }
+
+type nets []*net.IPNet
+
+// parseNets parses CIDRs or single IPs.
+func parseNets(cidrs []string) nets {
+	var nets nets
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic("ratelimit: invalid trusted proxy " + err.Error())
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func (nets nets) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// client walks the hops reported by proxies from the right and returns
+// the first one not trusted.
+func (nets nets) client(r *http.Request, hops []string) string {
+	ip := IP(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !nets.contains(net.ParseIP(ip)) {
+			return ip
+		}
+		hop := parseHop(hops[i])
+		if hop == nil {
+			// Garbage from a trusted proxy, don't go any further.
+			return ip
+		}
+		ip = hop.String()
+	}
+	return ip
+}
+
+// parseHop parses IP with optional port, quotes and brackets, ie.
+// `"[2001:db8:cafe::17]:4711"`.
+func parseHop(hop string) net.IP {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
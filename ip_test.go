@@ -0,0 +1,103 @@
+package ratelimit_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/VojtechVitek/ratelimit"
+)
+
+func ExampleClientIP() {
+	keyFn := ratelimit.ClientIP("10.0.0.0/8")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "1.1.1.1, 203.0.113.7, 10.0.0.2")
+	fmt.Println(keyFn(r))
+
+	// Output: 203.0.113.7
+}
+
+func ExampleClientIPForwarded() {
+	keyFn := ratelimit.ClientIPForwarded("10.0.0.0/8")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("Forwarded", `for=1.1.1.1, for="[2001:db8:cafe::17]:4711";proto=https`)
+	fmt.Println(keyFn(r))
+
+	// Output: 2001:db8:cafe::17
+}
+
+func ExampleClientIPHeader() {
+	keyFn := ratelimit.ClientIPHeader("CF-Connecting-IP", "173.245.48.0/20")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.7:1234"
+	r.Header.Set("CF-Connecting-IP", "1.1.1.1")
+	fmt.Println(keyFn(r))
+
+	// Output: 203.0.113.7
+}
+
+func ExampleSubnet() {
+	keyFn := ratelimit.Subnet(ratelimit.IP, 24, 64)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "[2001:db8:cafe:17:1:2:3:4]:1234"
+	fmt.Println(keyFn(r))
+
+	r.RemoteAddr = "203.0.113.7:1234"
+	fmt.Println(keyFn(r))
+
+	// Output:
+	// 2001:db8:cafe:17::/64
+	// 203.0.113.0/24
+}
+
+func TestClientIP(t *testing.T) {
+	xff := ratelimit.ClientIP("10.0.0.0/8")
+	forwarded := ratelimit.ClientIPForwarded("10.0.0.0/8")
+	cf := ratelimit.ClientIPHeader("CF-Connecting-IP", "173.245.48.0/20")
+
+	tests := []struct {
+		keyFn      ratelimit.KeyFn
+		remoteAddr string
+		header     http.Header
+		want       string
+	}{
+		// Headers sent by an untrusted peer are ignored.
+		{xff, "203.0.113.7:1234", http.Header{"X-Forwarded-For": {"1.1.1.1"}}, "203.0.113.7"},
+		{forwarded, "203.0.113.7:1234", http.Header{"Forwarded": {"for=1.1.1.1"}}, "203.0.113.7"},
+		{cf, "203.0.113.7:1234", http.Header{"Cf-Connecting-Ip": {"1.1.1.1"}}, "203.0.113.7"},
+		// Hops left of the first untrusted one are ignored.
+		{xff, "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"6.6.6.6, 203.0.113.7, 10.0.0.2"}}, "203.0.113.7"},
+		{xff, "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"6.6.6.6", "203.0.113.7"}}, "203.0.113.7"},
+		// Fully trusted chain ends with the leftmost hop.
+		{xff, "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{xff, "10.0.0.1:1234", nil, "10.0.0.1"},
+		// Garbage stops the walk at the proxy which sent it.
+		{xff, "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"1.1.1.1, garbage"}}, "10.0.0.1"},
+		{xff, "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"1.1.1.1, garbage, 10.0.0.2"}}, "10.0.0.2"},
+		{forwarded, "10.0.0.1:1234", http.Header{"Forwarded": {"for=unknown"}}, "10.0.0.1"},
+		{forwarded, "10.0.0.1:1234", http.Header{"Forwarded": {"for=1.1.1.1, for=_hidden"}}, "10.0.0.1"},
+		{forwarded, "10.0.0.1:1234", http.Header{"Forwarded": {"proto=https"}}, "10.0.0.1"},
+		{cf, "173.245.48.1:1234", http.Header{"Cf-Connecting-Ip": {"garbage"}}, "173.245.48.1"},
+		// Headers sent by a trusted peer are followed.
+		{forwarded, "10.0.0.1:1234", http.Header{"Forwarded": {`for="[2001:db8::1]:4711"`}}, "2001:db8::1"},
+		{cf, "173.245.48.1:1234", http.Header{"Cf-Connecting-Ip": {"1.1.1.1"}}, "1.1.1.1"},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		r.Header = tt.header
+		if r.Header == nil {
+			r.Header = http.Header{}
+		}
+		if got := tt.keyFn(r); got != tt.want {
+			t.Errorf("%d: got %q, want %q", i, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Header returns KeyFn keyed by the value of a given request header.
+func Header(name string) KeyFn {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// Query returns KeyFn keyed by the value of a given URL query parameter.
+func Query(name string) KeyFn {
+	return func(r *http.Request) string {
+		return r.URL.Query().Get(name)
+	}
+}
+
+// Cookie returns KeyFn keyed by the value of a given cookie.
+func Cookie(name string) KeyFn {
+	return func(r *http.Request) string {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+}
+
+// ContextValue returns KeyFn keyed by the value stored in the request
+// context under a given key, ie. user ID set by authentication middleware.
+func ContextValue(key interface{}) KeyFn {
+	return func(r *http.Request) string {
+		switch v := r.Context().Value(key).(type) {
+		case nil:
+			return ""
+		case string:
+			return v
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+}
+
+// BasicAuthUser returns unique key per HTTP Basic Auth user name.
+func BasicAuthUser(r *http.Request) string {
+	user, _, _ := r.BasicAuth()
+	return user
+}
+
+// BearerToken returns unique key per bearer token sent in Authorization
+// header. The token is hashed, so it doesn't leak to the store.
+func BearerToken(r *http.Request) string {
+	return hash(bearerToken(r))
+}
+
+// JWTClaim returns KeyFn keyed by a given claim of the JWT bearer token,
+// ie. "sub". The token is NOT verified, it must be verified by
+// an authentication middleware upstream.
+func JWTClaim(claim string) KeyFn {
+	return func(r *http.Request) string {
+		parts := strings.Split(bearerToken(r), ".")
+		if len(parts) != 3 {
+			return ""
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		if err != nil {
+			return ""
+		}
+		// Keep numeric claims as they are, rather than as float64.
+		dec := json.NewDecoder(bytes.NewReader(payload))
+		dec.UseNumber()
+		var claims map[string]interface{}
+		if err := dec.Decode(&claims); err != nil {
+			return ""
+		}
+		switch v := claims[claim].(type) {
+		case nil:
+			return ""
+		case string:
+			return v
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+}
+
+// Join returns KeyFn keyed by all of the given keys. It returns empty key
+// if any of them is empty. The keys are joined by ":", which is escaped in
+// each of them, so clients can't pick keys colliding with other clients'
+// ones, ie. "acme:42" and "x" don't join into the same key as "acme" and
+// "42:x".
+func Join(keyFns ...KeyFn) KeyFn {
+	return func(r *http.Request) string {
+		keys := make([]string, len(keyFns))
+		for i, keyFn := range keyFns {
+			keys[i] = keyFn(r)
+			if keys[i] == "" {
+				return ""
+			}
+			keys[i] = escapeKey.Replace(keys[i])
+		}
+		return strings.Join(keys, ":")
+	}
+}
+
+// escapeKey escapes the separator of joined keys.
+var escapeKey = strings.NewReplacer(`\`, `\\`, ":", `\:`)
+
+// FirstNonEmpty returns KeyFn keyed by the first non-empty key, ie.
+// FirstNonEmpty(BasicAuthUser, IP). The key is prefixed by the index of its
+// KeyFn, so clients can't pick keys colliding with keys of the other KeyFns,
+// ie. Basic Auth user "192.0.2.1" doesn't share the bucket of that IP.
+func FirstNonEmpty(keyFns ...KeyFn) KeyFn {
+	return func(r *http.Request) string {
+		for i, keyFn := range keyFns {
+			if key := keyFn(r); key != "" {
+				return strconv.Itoa(i) + ":" + key
+			}
+		}
+		return ""
+	}
+}
+
+// Hash returns KeyFn keyed by SHA-256 hash of a given key, so long or
+// sensitive keys are not stored as they are.
+func Hash(keyFn KeyFn) KeyFn {
+	return func(r *http.Request) string {
+		return hash(keyFn(r))
+	}
+}
+
+func hash(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
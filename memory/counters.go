@@ -0,0 +1,69 @@
+package memory
+
+import (
+	"sync"
+	"time"
+)
+
+type counter struct {
+	entry
+	value int
+}
+
+// counterShard holds a subset of the counters guarded by its own lock.
+type counterShard struct {
+	sync.Mutex // guards counters and expiry
+	counters   map[string]*counter
+	expiry     expiry
+}
+
+type counterStore struct {
+	shards [shards]counterShard
+}
+
+// NewCounterStore creates new in-memory counter store, ie. for
+// the slidingwindow package.
+func NewCounterStore() *counterStore {
+	s := &counterStore{}
+	for i := range s.shards {
+		s.shards[i].counters = map[string]*counter{}
+	}
+	return s
+}
+
+// Incr implements slidingwindow.CounterStore interface.
+func (s *counterStore) Incr(key string, prevKey string, n int, ttl time.Duration) (int, int, error) {
+	now := time.Now()
+
+	// Lock the shards in order, so concurrent calls can't deadlock.
+	i, j := shardOf(key), shardOf(prevKey)
+	sh, prevSh := &s.shards[i], &s.shards[j]
+	if i > j {
+		i, j = j, i
+	}
+	s.shards[i].Lock()
+	defer s.shards[i].Unlock()
+	if i != j {
+		s.shards[j].Lock()
+		defer s.shards[j].Unlock()
+	}
+
+	// Drop expired counters in order, so only the dropped ones are visited.
+	for _, key := range sh.expiry.expire(now) {
+		delete(sh.counters, key)
+	}
+
+	c, ok := sh.counters[key]
+	if !ok {
+		c = &counter{entry: entry{key: key}}
+		sh.counters[key] = c
+	}
+	c.value += n
+	sh.expiry.set(&c.entry, now.Add(ttl), !ok)
+
+	prev := 0
+	if p, ok := prevSh.counters[prevKey]; ok && !now.After(p.expires) {
+		prev = p.value
+	}
+	return prev, c.value, nil
+}
@@ -0,0 +1,35 @@
+package memory_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VojtechVitek/ratelimit/memory"
+)
+
+func TestCounterStoreIncr(t *testing.T) {
+	store := memory.NewCounterStore()
+
+	tests := []struct {
+		key, prevKey string
+		n            int
+		sleep        time.Duration // before the call
+		prev, curr   int
+	}{
+		{key: "a:1", prevKey: "a:0", n: 2, prev: 0, curr: 2},
+		{key: "a:1", prevKey: "a:0", n: 3, prev: 0, curr: 5},
+		{key: "a:2", prevKey: "a:1", n: 1, prev: 5, curr: 1},
+		// Expired counters start over.
+		{key: "a:2", prevKey: "a:1", n: 1, sleep: 60 * time.Millisecond, prev: 0, curr: 1},
+	}
+	for i, tt := range tests {
+		time.Sleep(tt.sleep)
+		prev, curr, err := store.Incr(tt.key, tt.prevKey, tt.n, 50*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prev != tt.prev || curr != tt.curr {
+			t.Errorf("%d: got %d, %d, want %d, %d", i, prev, curr, tt.prev, tt.curr)
+		}
+	}
+}
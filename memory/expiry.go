@@ -0,0 +1,69 @@
+package memory
+
+import (
+	"container/heap"
+	"time"
+)
+
+// entry is a key expiring at a given time.
+type entry struct {
+	key     string
+	expires time.Time
+	index   int // index in the expiry heap
+}
+
+// expiry is a min-heap of entries ordered by the time they expire, so
+// dropping the expired entries doesn't visit the others.
+type expiry []*entry
+
+func (h expiry) Len() int           { return len(h) }
+func (h expiry) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h expiry) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiry) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiry) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// set sets expiration of the entry, adding it to the heap if it's new.
+func (h *expiry) set(e *entry, expires time.Time, added bool) {
+	e.expires = expires
+	if added {
+		heap.Push(h, e)
+		return
+	}
+	heap.Fix(h, e.index)
+}
+
+// expire removes the entries expired before now and returns their keys.
+func (h *expiry) expire(now time.Time) []string {
+	var keys []string
+	for len(*h) > 0 && (*h)[0].expires.Before(now) {
+		keys = append(keys, heap.Pop(h).(*entry).key)
+	}
+	return keys
+}
+
+// shardOf returns index of the shard holding a given key, ie. its FNV-1a
+// hash.
+func shardOf(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % shards)
+}
@@ -1,62 +1,374 @@
 package memory
 
 import (
+	"container/heap"
+	"context"
+	"errors"
+	"math"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/VojtechVitek/ratelimit"
 )
 
-type token struct{}
+// bucket holds number of tokens available at the time of the last update.
+// Tokens gained since then are computed on demand from the elapsed time.
+type bucket struct {
+	key      string
+	tokens   float64
+	last     time.Time
+	burst    float64
+	interval float64   // nanoseconds to refill a single token
+	full     time.Time // time the bucket gets fully refilled
+	index    int       // index in the shard's heap
+	pinned   bool      // taken by the batch in progress, must not be dropped
+}
 
-type bucketStore struct {
-	sync.Mutex // guards buckets
-	buckets    map[string]chan token
-	bucketLen  int
-	reset      time.Time
-}
-
-// New creates new in-memory token bucket store.
-func New() *bucketStore {
-	return &bucketStore{
-		buckets: map[string]chan token{},
-	}
-}
-
-func (s *bucketStore) InitRate(rate int, window time.Duration) {
-	s.bucketLen = rate
-	s.reset = time.Now()
-
-	go func() {
-		interval := time.Duration(int(window) / rate)
-		tick := time.NewTicker(interval)
-		for t := range tick.C {
-			s.Lock()
-			s.reset = t.Add(interval)
-			for key, bucket := range s.buckets {
-				select {
-				case <-bucket:
-				default:
-					delete(s.buckets, key)
-				}
+// refill adds tokens gained since the last update of the bucket.
+func (b *bucket) refill(now time.Time) float64 {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+float64(elapsed)/b.interval)
+		b.last = now
+	}
+	return b.tokens
+}
+
+// result returns result of taking n tokens from the bucket. The reset is
+// the time the bucket gains its next whole token, or enough tokens.
+func (b *bucket) result(taken bool, n int) ratelimit.TakeResult {
+	need := math.Floor(b.tokens) + 1
+	if !taken {
+		need = float64(n)
+	}
+	return ratelimit.TakeResult{
+		Taken:     taken,
+		Remaining: int(b.tokens),
+		Reset:     b.last.Add(time.Duration((need - b.tokens) * b.interval)),
+	}
+}
+
+// buckets is a min-heap of buckets ordered by the time they get fully
+// refilled, so the sweeper only visits the buckets it drops.
+type buckets []*bucket
+
+func (h buckets) Len() int           { return len(h) }
+func (h buckets) Less(i, j int) bool { return h[i].full.Before(h[j].full) }
+func (h buckets) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *buckets) Push(x interface{}) {
+	b := x.(*bucket)
+	b.index = len(*h)
+	*h = append(*h, b)
+}
+
+func (h *buckets) Pop() interface{} {
+	old := *h
+	b := old[len(old)-1]
+	b.index = -1
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return b
+}
+
+// ErrFull is returned when a bucket of a new key can't be created, as
+// the store reached MaxKeys or MaxBytes and none of its buckets is fully
+// refilled.
+var ErrFull = errors.New("memory store is full")
+
+const (
+	shards = 64
+
+	sweepInterval = time.Minute
+
+	// bucketSize is approximate number of bytes held by a bucket, including
+	// its map and heap entries, but excluding its key.
+	bucketSize = 256
+)
+
+// Option configures the store created by New.
+type Option func(*bucketStore)
+
+// MaxKeys caps the number of buckets held by the store. Defaults to no cap.
+func MaxKeys(n int) Option {
+	return func(s *bucketStore) {
+		s.usage.maxKeys = int64(n)
+	}
+}
+
+// MaxBytes caps approximate number of bytes held by the buckets, including
+// their keys. Defaults to no cap.
+func MaxBytes(n int64) Option {
+	return func(s *bucketStore) {
+		s.usage.maxBytes = n
+	}
+}
+
+// usage tracks the buckets held by the store against its caps.
+type usage struct {
+	keys  int64 // accessed atomically
+	bytes int64 // accessed atomically
+
+	maxKeys  int64
+	maxBytes int64
+}
+
+// add accounts for a new bucket of a given size, unless it would exceed
+// the caps.
+func (u *usage) add(size int64) bool {
+	keys := atomic.AddInt64(&u.keys, 1)
+	bytes := atomic.AddInt64(&u.bytes, size)
+	if (u.maxKeys > 0 && keys > u.maxKeys) || (u.maxBytes > 0 && bytes > u.maxBytes) {
+		u.remove(size)
+		return false
+	}
+	return true
+}
+
+// remove accounts for a dropped bucket of a given size.
+func (u *usage) remove(size int64) {
+	atomic.AddInt64(&u.keys, -1)
+	atomic.AddInt64(&u.bytes, -size)
+}
+
+// shard holds a subset of the buckets guarded by its own lock, so takes
+// of different keys don't contend with each other.
+type shard struct {
+	sync.Mutex // guards buckets and full
+	buckets    map[string]*bucket
+	full       buckets
+
+	usage *usage
+}
+
+// bucket returns the bucket referenced by a given key, refilled up to now.
+// It returns nil if there's no such bucket and the store is full. The caller
+// must hold the lock and call update once done with the bucket.
+func (s *shard) bucket(key string, limit ratelimit.Limit, now time.Time) *bucket {
+	b, ok := s.buckets[key]
+	if !ok {
+		size := int64(bucketSize + len(key))
+		for !s.usage.add(size) {
+			// Only the full buckets are dropped to make room, as they are
+			// no different from the new ones. Dropping any other bucket
+			// would hand its owner fresh tokens next time, ie. the client
+			// could reset its own bucket by flooding the store with new keys.
+			if len(s.full) == 0 || s.full[0].pinned || s.full[0].full.After(now) {
+				return nil
 			}
-			s.Unlock()
+			s.drop(s.full[0])
 		}
-	}()
+		b = &bucket{key: key, tokens: float64(limit.Burst), last: now}
+		s.buckets[key] = b
+		heap.Push(&s.full, b)
+	}
+	b.burst = float64(limit.Burst)
+	b.interval = float64(limit.Window) / float64(limit.Rate)
+	b.refill(now)
+	return b
 }
 
-// Take implements TokenBucketStore interface. It takes token from a bucket
-// referenced by a given key, if available.
-func (s *bucketStore) Take(key string) (bool, int, time.Time, error) {
+// update reorders the bucket by the time it gets fully refilled.
+// The caller must hold the lock.
+func (s *shard) update(b *bucket) {
+	b.full = b.last.Add(time.Duration((b.burst - b.tokens) * b.interval))
+	heap.Fix(&s.full, b.index)
+}
+
+// drop removes the bucket from the shard.
+func (s *shard) drop(b *bucket) {
+	delete(s.buckets, b.key)
+	heap.Remove(&s.full, b.index)
+	s.usage.remove(int64(bucketSize + len(b.key)))
+}
+
+// sweep drops buckets fully refilled by now, which are no different
+// from the new ones.
+func (s *shard) sweep(now time.Time) {
 	s.Lock()
-	bucket, ok := s.buckets[key]
-	if !ok {
-		bucket = make(chan token, s.bucketLen)
-		s.buckets[key] = bucket
+	defer s.Unlock()
+
+	for len(s.full) > 0 && !s.full[0].full.After(now) {
+		s.drop(s.full[0])
 	}
-	s.Unlock()
+}
+
+type bucketStore struct {
+	usage  usage
+	shards [shards]shard
+
+	wake   chan struct{}
+	close  sync.Once
+	done   chan struct{}
+	closed chan struct{}
+}
+
+// New creates new in-memory token bucket store. It runs a goroutine
+// dropping unused buckets until the store is closed.
+//
+// Once the store reaches MaxKeys or MaxBytes, it makes room for new buckets
+// by dropping the ones fully refilled. If there are none, takes of the new
+// keys fail with ErrFull until some buckets get fully refilled, so no client
+// can get rid of its bucket by flooding the store with new keys. Limiters
+// pass such takes to their fallback stores, or let the requests through if
+// there are none. The existing keys stay limited, while a flood of new keys
+// can't lock new clients out until the slowest bucket refills.
+func New(opts ...Option) *bucketStore {
+	s := &bucketStore{
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	for i := range s.shards {
+		s.shards[i].buckets = map[string]*bucket{}
+		s.shards[i].usage = &s.usage
+	}
+
+	go s.sweep()
+
+	return s
+}
+
+// sweep drops fully refilled buckets every sweepInterval, or as soon as
+// the store is full.
+func (s *bucketStore) sweep() {
+	defer close(s.closed)
+
+	tick := time.NewTicker(sweepInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-tick.C:
+		case <-s.wake:
+		}
+		now := time.Now()
+		for i := range s.shards {
+			s.shards[i].sweep(now)
+		}
+	}
+}
+
+// full wakes up the sweeper to make room in the other shards, as the store
+// is full.
+func (s *bucketStore) full() {
 	select {
-	case bucket <- token{}:
-		return true, cap(bucket) - len(bucket), s.reset, nil
+	case s.wake <- struct{}{}:
 	default:
-		return false, 0, s.reset, nil
 	}
 }
+
+// Close implements io.Closer interface. It stops the goroutine dropping
+// unused buckets and waits for it to exit. The store must not be used
+// after Close.
+func (s *bucketStore) Close() error {
+	s.close.Do(func() {
+		close(s.done)
+	})
+	<-s.closed
+	return nil
+}
+
+// Size returns number of buckets held by the store and approximate number
+// of bytes they take.
+func (s *bucketStore) Size() (keys int, bytes int64) {
+	return int(atomic.LoadInt64(&s.usage.keys)), atomic.LoadInt64(&s.usage.bytes)
+}
+
+// TakeContext implements ContextTokenBucketStore interface. It takes
+// n tokens from a bucket referenced by a given key, unless ctx is done.
+func (s *bucketStore) TakeContext(ctx context.Context, key string, limit ratelimit.Limit, n int) (bool, int, time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return false, 0, time.Time{}, err
+	}
+	return s.Take(key, limit, n)
+}
+
+// Take implements TokenBucketStore interface. It takes n tokens from
+// a bucket referenced by a given key, if available.
+func (s *bucketStore) Take(key string, limit ratelimit.Limit, n int) (bool, int, time.Time, error) {
+	sh := &s.shards[shardOf(key)]
+	sh.Lock()
+	defer sh.Unlock()
+
+	b := sh.bucket(key, limit, time.Now())
+	if b == nil {
+		s.full()
+		return false, 0, time.Time{}, ErrFull
+	}
+	taken := b.tokens >= float64(n)
+	if taken {
+		b.tokens -= float64(n)
+	}
+	sh.update(b)
+
+	result := b.result(taken, n)
+	return result.Taken, result.Remaining, result.Reset, nil
+}
+
+// TakeBatch implements BatchTokenBucketStore interface. It takes tokens
+// from all of the buckets, if available in each of them.
+func (s *bucketStore) TakeBatch(ctx context.Context, takes []ratelimit.TakeRequest) ([]ratelimit.TakeResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Lock the shards in order, so concurrent batches can't deadlock.
+	idx := make([]int, len(takes))
+	var locks []int
+	for i, take := range takes {
+		idx[i] = shardOf(take.Key)
+		locks = append(locks, idx[i])
+	}
+	sort.Ints(locks)
+	for i, j := range locks {
+		if i == 0 || j != locks[i-1] {
+			s.shards[j].Lock()
+			defer s.shards[j].Unlock()
+		}
+	}
+
+	now := time.Now()
+	buckets := make([]*bucket, 0, len(takes))
+	defer func() {
+		for _, b := range buckets {
+			b.pinned = false
+		}
+	}()
+	taken := true
+	for i, take := range takes {
+		b := s.shards[idx[i]].bucket(take.Key, take.Limit, now)
+		if b == nil {
+			s.full()
+			return nil, ErrFull
+		}
+		// Don't drop the bucket to make room for the rest of the batch,
+		// the tokens taken from it would be lost.
+		b.pinned = true
+		buckets = append(buckets, b)
+		if b.tokens < float64(take.N) {
+			taken = false
+		}
+	}
+
+	results := make([]ratelimit.TakeResult, len(takes))
+	for i, take := range takes {
+		b := buckets[i]
+		if taken {
+			b.tokens -= float64(take.N)
+		}
+		s.shards[idx[i]].update(b)
+		results[i] = b.result(taken || b.tokens >= float64(take.N), take.N)
+	}
+	return results, nil
+}
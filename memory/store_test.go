@@ -0,0 +1,180 @@
+package memory_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/VojtechVitek/ratelimit"
+	"github.com/VojtechVitek/ratelimit/memory"
+)
+
+func TestStoreTake(t *testing.T) {
+	limit := ratelimit.Limit{Rate: 10, Window: time.Second, Burst: 3}
+
+	tests := []struct {
+		n         int
+		taken     bool
+		remaining int
+		reset     time.Duration // since the take, rounded to milliseconds
+	}{
+		{n: 1, taken: true, remaining: 2, reset: 100 * time.Millisecond},
+		{n: 2, taken: true, remaining: 0, reset: 100 * time.Millisecond},
+		{n: 1, taken: false, remaining: 0, reset: 100 * time.Millisecond},
+		{n: 3, taken: false, remaining: 0, reset: 300 * time.Millisecond},
+	}
+
+	store := memory.New()
+	defer store.Close()
+	for i, tt := range tests {
+		now := time.Now()
+		taken, remaining, reset, err := store.Take("key", limit, tt.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if taken != tt.taken || remaining != tt.remaining {
+			t.Errorf("%d: got taken %v, remaining %d, want %v, %d", i, taken, remaining, tt.taken, tt.remaining)
+		}
+		if got := reset.Sub(now).Round(10 * time.Millisecond); got != tt.reset {
+			t.Errorf("%d: got reset in %v, want %v", i, got, tt.reset)
+		}
+	}
+}
+
+func TestStoreMaxKeys(t *testing.T) {
+	limit := ratelimit.Limit{Rate: 1, Window: time.Hour, Burst: 1}
+
+	tests := []struct {
+		opt      memory.Option
+		keys     int
+		maxKeys  int
+		maxBytes int64
+	}{
+		{opt: memory.MaxKeys(10), keys: 1000, maxKeys: 10},
+		{opt: memory.MaxKeys(100), keys: 50, maxKeys: 50},
+		{opt: memory.MaxBytes(4096), keys: 1000, maxBytes: 4096},
+	}
+	for i, tt := range tests {
+		store := memory.New(tt.opt)
+		for j := 0; j < tt.keys; j++ {
+			store.Take(fmt.Sprintf("key%d", j), limit, 1)
+		}
+		keys, bytes := store.Size()
+		if tt.maxKeys > 0 && keys != tt.maxKeys {
+			t.Errorf("%d: got %d keys, want %d", i, keys, tt.maxKeys)
+		}
+		if tt.maxBytes > 0 && (bytes > tt.maxBytes || bytes < tt.maxBytes/2) {
+			t.Errorf("%d: got %d bytes, want up to %d", i, bytes, tt.maxBytes)
+		}
+		store.Close()
+	}
+}
+
+func TestStoreFloodDoesNotReset(t *testing.T) {
+	store := memory.New(memory.MaxKeys(64))
+	defer store.Close()
+
+	slow := ratelimit.Limit{Rate: 10, Window: time.Hour, Burst: 10}
+	fast := ratelimit.Limit{Rate: 100, Window: time.Second, Burst: 10}
+
+	// The client drains its bucket, then floods the store with new keys
+	// of a fast limit, which get fully refilled in no time.
+	for {
+		if taken, _, _, _ := store.Take("attacker", slow, 1); !taken {
+			break
+		}
+	}
+	for i := 0; i < 2000; i++ {
+		store.Take(fmt.Sprintf("flood%d", i), fast, 1)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if taken, _, _, _ := store.Take("attacker", slow, 1); taken {
+		t.Error("flooding the store reset the drained bucket")
+	}
+}
+
+func TestStoreDropsFullBuckets(t *testing.T) {
+	store := memory.New(memory.MaxKeys(1))
+	defer store.Close()
+
+	limit := ratelimit.Limit{Rate: 100, Window: time.Second, Burst: 1}
+	if taken, _, _, _ := store.Take("a", limit, 1); !taken {
+		t.Fatal("first key not taken")
+	}
+	if _, _, _, err := store.Take("b", limit, 1); err != memory.ErrFull {
+		t.Errorf("got error %v while the store is full, want ErrFull", err)
+	}
+
+	// Once the first bucket gets fully refilled, it makes room for the other.
+	deadline := time.Now().Add(time.Second)
+	for {
+		time.Sleep(5 * time.Millisecond)
+		if taken, _, _, err := store.Take("b", limit, 1); taken && err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("full bucket not dropped to make room")
+		}
+	}
+	if keys, _ := store.Size(); keys != 1 {
+		t.Errorf("got %d keys, want 1", keys)
+	}
+}
+
+func TestStoreTakeBatch(t *testing.T) {
+	a := ratelimit.Limit{Rate: 2, Window: time.Hour, Burst: 2}
+	b := ratelimit.Limit{Rate: 5, Window: time.Hour, Burst: 5}
+
+	tests := []struct {
+		na, nb     int
+		taken      bool
+		remainingA int
+		remainingB int
+	}{
+		{na: 1, nb: 1, taken: true, remainingA: 1, remainingB: 4},
+		// All or nothing, b is not charged while a lacks the tokens.
+		{na: 2, nb: 1, taken: false, remainingA: 1, remainingB: 4},
+		{na: 1, nb: 4, taken: true, remainingA: 0, remainingB: 0},
+		{na: 0, nb: 1, taken: false, remainingA: 0, remainingB: 0},
+	}
+
+	store := memory.New()
+	defer store.Close()
+	for i, tt := range tests {
+		results, err := store.TakeBatch(context.Background(), []ratelimit.TakeRequest{
+			{Key: "a", Limit: a, N: tt.na},
+			{Key: "b", Limit: b, N: tt.nb},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if taken := results[0].Taken && results[1].Taken; taken != tt.taken {
+			t.Errorf("%d: got taken %v, want %v", i, taken, tt.taken)
+		}
+		if results[0].Remaining != tt.remainingA || results[1].Remaining != tt.remainingB {
+			t.Errorf("%d: got remaining %d, %d, want %d, %d", i, results[0].Remaining, results[1].Remaining, tt.remainingA, tt.remainingB)
+		}
+	}
+}
+
+func TestStoreTakeBatchFull(t *testing.T) {
+	store := memory.New(memory.MaxKeys(1))
+	defer store.Close()
+
+	limit := ratelimit.Limit{Rate: 5, Window: time.Hour, Burst: 5}
+	store.Take("a", limit, 1)
+
+	// The new key can't be stored, so the existing one is not charged.
+	_, err := store.TakeBatch(context.Background(), []ratelimit.TakeRequest{
+		{Key: "a", Limit: limit, N: 1},
+		{Key: "b", Limit: limit, N: 1},
+	})
+	if err != memory.ErrFull {
+		t.Errorf("got error %v while the store is full, want ErrFull", err)
+	}
+	if _, remaining, _, _ := store.Take("a", limit, 1); remaining != 3 {
+		t.Errorf("got remaining %d, want 3", remaining)
+	}
+}
@@ -0,0 +1,55 @@
+package memory
+
+import (
+	"sync"
+	"time"
+)
+
+// tatShard holds a subset of the TATs guarded by its own lock.
+type tatShard struct {
+	sync.Mutex // guards tats and expiry
+	tats       map[string]*entry
+	expiry     expiry
+}
+
+type tatStore struct {
+	shards [shards]tatShard
+}
+
+// NewTATStore creates new in-memory store of theoretical arrival times,
+// ie. for the gcra package.
+func NewTATStore() *tatStore {
+	s := &tatStore{}
+	for i := range s.shards {
+		s.shards[i].tats = map[string]*entry{}
+	}
+	return s
+}
+
+// Advance implements gcra.TATStore interface.
+func (s *tatStore) Advance(key string, now time.Time, increment, tolerance time.Duration) (time.Time, bool, error) {
+	sh := &s.shards[shardOf(key)]
+	sh.Lock()
+	defer sh.Unlock()
+
+	// Drop TATs in the past, in order, so only the dropped ones are visited.
+	for _, key := range sh.expiry.expire(now) {
+		delete(sh.tats, key)
+	}
+
+	e, ok := sh.tats[key]
+	tat := now
+	if ok && e.expires.After(now) {
+		tat = e.expires
+	}
+	newTAT := tat.Add(increment)
+	if newTAT.Sub(now) > tolerance {
+		return tat, false, nil
+	}
+	if !ok {
+		e = &entry{key: key}
+		sh.tats[key] = e
+	}
+	sh.expiry.set(e, newTAT, !ok)
+	return newTAT, true, nil
+}
@@ -1,16 +1,133 @@
 package ratelimit
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"runtime"
 	"time"
 )
 
 // TokenBucketStore is an interface for for any storage implementing
 // Token Bucket algorithm.
+//
+// Take removes n tokens from the bucket referenced by key, which refills
+// at a given limit, or none of them if there's not enough tokens in the
+// bucket. The returned reset is the time at which the bucket gains its next
+// token or, if the tokens were not taken, the time at which it will hold
+// enough tokens. The store keeps no limits of its own, so a single store
+// can back any number of limiters.
 type TokenBucketStore interface {
-	InitRate(rate int, window time.Duration)
-	Take(key string) (taken bool, remaining int, reset time.Time, err error)
+	Take(key string, limit Limit, n int) (taken bool, remaining int, reset time.Time, err error)
+}
+
+// ContextTokenBucketStore is a TokenBucketStore which stops waiting on
+// the storage once the context is done, ie. when the client goes away.
+type ContextTokenBucketStore interface {
+	TokenBucketStore
+	TakeContext(ctx context.Context, key string, limit Limit, n int) (taken bool, remaining int, reset time.Time, err error)
+}
+
+// Limit is a rate of tokens per window, allowing for a given burst.
+type Limit struct {
+	Rate   int
+	Window time.Duration
+	Burst  int
+}
+
+// String returns the limit formatted as rate/window/burst, ie. 30/1m0s/10.
+func (l Limit) String() string {
+	return fmt.Sprintf("%d/%v/%d", l.Rate, l.Window, l.Burst)
+}
+
+// TakeRequest requests N tokens from the bucket referenced by Key.
+type TakeRequest struct {
+	Key   string
+	Limit Limit
+	N     int
+}
+
+// TakeResult is the result of TakeRequest. Taken reports whether the bucket
+// holds enough tokens.
+type TakeResult struct {
+	Taken     bool
+	Remaining int
+	Reset     time.Time
+}
+
+// BatchTokenBucketStore is an interface for any storage able to take
+// tokens from several buckets, each with its own limit, at once. Either
+// all of the requested tokens are taken, or none of them.
+type BatchTokenBucketStore interface {
+	TakeBatch(ctx context.Context, takes []TakeRequest) ([]TakeResult, error)
 }
 
 // KeyFn is a function returning bucket key depending on request data.
 type KeyFn func(r *http.Request) string
+
+// take takes n tokens from the bucket referenced by key. The fallback
+// stores are tried in order for as long as the previous store fails.
+func take(ctx context.Context, store TokenBucketStore, fallbackStores []TokenBucketStore, key string, limit Limit, n int) (taken bool, remaining int, reset time.Time, err error) {
+	taken, remaining, reset, err = takeContext(ctx, store, key, limit, n)
+	for _, store := range fallbackStores {
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		taken, remaining, reset, err = takeContext(ctx, store, key, limit, n)
+	}
+	return
+}
+
+// takeContext passes ctx to the store, if it supports it.
+func takeContext(ctx context.Context, store TokenBucketStore, key string, limit Limit, n int) (bool, int, time.Time, error) {
+	if store, ok := store.(ContextTokenBucketStore); ok {
+		return store.TakeContext(ctx, key, limit, n)
+	}
+	if err := ctx.Err(); err != nil {
+		return false, 0, time.Time{}, err
+	}
+	return store.Take(key, limit, n)
+}
+
+// takeBatch takes tokens from several buckets at once. The fallback
+// stores are tried in order for as long as the previous store fails.
+func takeBatch(ctx context.Context, store TokenBucketStore, fallbackStores []TokenBucketStore, takes []TakeRequest) (results []TakeResult, err error) {
+	results, err = store.(BatchTokenBucketStore).TakeBatch(ctx, takes)
+	for _, store := range fallbackStores {
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		results, err = store.(BatchTokenBucketStore).TakeBatch(ctx, takes)
+	}
+	return
+}
+
+// sleep pauses for a given duration. It returns false if ctx was done
+// in the meantime.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// namespace returns namespace of a limiter's keys in the store, so limiters
+// sharing the store don't share their buckets. Unnamed limiters get the
+// function and line calling LimitBy, which are the same in all processes
+// running the same code, regardless of the order they create limiters in.
+// It must be called by LimitBy.
+func namespace(name string) string {
+	if name != "" {
+		return name
+	}
+	pc, _, line, ok := runtime.Caller(2)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s@%d", runtime.FuncForPC(pc).Name(), line)
+}
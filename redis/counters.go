@@ -0,0 +1,44 @@
+package redis
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+type counterStore struct {
+	pool *redis.Pool
+}
+
+// NewCounterStore creates new Redis counter store, ie. for
+// the slidingwindow package.
+func NewCounterStore(pool *redis.Pool) *counterStore {
+	return &counterStore{
+		pool: pool,
+	}
+}
+
+// Incr implements slidingwindow.CounterStore interface.
+func (s *counterStore) Incr(key string, prevKey string, n int, ttl time.Duration) (int, int, error) {
+	c := s.pool.Get()
+	defer c.Close()
+
+	c.Send("MULTI")
+	c.Send("INCRBY", PrefixKey+key, n)
+	c.Send("PEXPIRE", PrefixKey+key, int64(ttl/time.Millisecond))
+	c.Send("GET", PrefixKey+prevKey)
+	reply, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	curr, err := redis.Int(reply[0], nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	prev, err := redis.Int(reply[2], nil)
+	if err == redis.ErrNil {
+		prev, err = 0, nil
+	}
+	return prev, curr, err
+}
@@ -1,9 +1,13 @@
 package redis
 
 import (
+	"context"
 	"errors"
+	"math"
+	"sync/atomic"
 	"time"
 
+	"github.com/VojtechVitek/ratelimit"
 	"github.com/garyburd/redigo/redis"
 )
 
@@ -16,11 +20,9 @@ var (
 const skipOnUnhealthy = 1000
 
 type bucketStore struct {
-	pool *redis.Pool
+	retryAfter int64 // unix nanoseconds, accessed atomically
 
-	rate          int
-	windowSeconds int
-	retryAfter    *time.Time
+	pool *redis.Pool
 }
 
 // New creates new in-memory token bucket store.
@@ -30,65 +32,150 @@ func New(pool *redis.Pool) *bucketStore {
 	}
 }
 
-func (s *bucketStore) InitRate(rate int, window time.Duration) {
-	s.rate = rate
-	s.windowSeconds = int(window / time.Second)
-	if s.windowSeconds <= 1 {
-		s.windowSeconds = 1
-	}
-}
+// takeScript takes tokens from buckets stored as hashes of the number
+// of tokens and the time of the last update in microseconds. Tokens gained
+// since then are computed on demand. The tokens are taken from all of the
+// buckets, or from none of them if any bucket doesn't hold enough tokens.
+//
+// ARGV holds the current time, followed by the burst, microseconds to refill
+// a single token, milliseconds to refill an empty bucket and the number of
+// tokens to take for each key. It returns whether the bucket holds enough
+// tokens, the number of remaining tokens and microseconds until the bucket
+// gains its next token, or enough tokens, for each key.
+var takeScript = redis.NewScript(-1, `
+local now = tonumber(ARGV[1])
 
-// Take implements TokenBucketStore interface. It takes token from a bucket
-// referenced by a given key, if available.
-func (s *bucketStore) Take(key string) (bool, int, time.Time, error) {
-	if s.retryAfter != nil {
-		if s.retryAfter.After(time.Now()) {
-			return false, 0, time.Time{}, ErrUnreachable
-		}
-		s.retryAfter = nil
+local taken = true
+local tokens = {}
+for i, key in ipairs(KEYS) do
+	local burst = tonumber(ARGV[i*4-2])
+	local interval = tonumber(ARGV[i*4-1])
+	local n = tonumber(ARGV[i*4+1])
+
+	tokens[i] = burst
+	local bucket = redis.call("HMGET", key, "tokens", "ts")
+	if bucket[1] and bucket[2] then
+		local elapsed = math.max(0, now - tonumber(bucket[2]))
+		tokens[i] = math.min(burst, tonumber(bucket[1]) + elapsed / interval)
+	end
+	if tokens[i] < n then
+		taken = false
+	end
+end
+
+local reply = {}
+for i, key in ipairs(KEYS) do
+	local interval = tonumber(ARGV[i*4-1])
+	local ttl = tonumber(ARGV[i*4])
+	local n = tonumber(ARGV[i*4+1])
+
+	if taken then
+		tokens[i] = tokens[i] - n
+		redis.call("HMSET", key, "tokens", tokens[i], "ts", now)
+		redis.call("PEXPIRE", key, ttl)
+	end
+
+	local enough = 0
+	local need = n
+	if taken or tokens[i] >= n then
+		enough = 1
+		need = math.floor(tokens[i]) + 1
+	end
+	table.insert(reply, enough)
+	table.insert(reply, math.floor(tokens[i]))
+	table.insert(reply, math.ceil((need - tokens[i]) * interval))
+end
+return reply
+`)
+
+// Take implements TokenBucketStore interface. It takes n tokens from
+// a bucket referenced by a given key, if available.
+func (s *bucketStore) Take(key string, limit ratelimit.Limit, n int) (bool, int, time.Time, error) {
+	results, err := s.take([]ratelimit.TakeRequest{{Key: key, Limit: limit, N: n}})
+	if err != nil {
+		return false, 0, time.Time{}, err
 	}
-	c := s.pool.Get()
-	defer c.Close()
+	return results[0].Taken, results[0].Remaining, results[0].Reset, nil
+}
 
-	// Number of tokens in the bucket.
-	bucketLen, err := redis.Int(c.Do("LLEN", PrefixKey+key))
+// TakeContext implements ContextTokenBucketStore interface. It takes
+// n tokens from a bucket referenced by a given key, if available. It
+// returns as soon as ctx is done, without waiting for Redis to reply.
+func (s *bucketStore) TakeContext(ctx context.Context, key string, limit ratelimit.Limit, n int) (bool, int, time.Time, error) {
+	results, err := s.TakeBatch(ctx, []ratelimit.TakeRequest{{Key: key, Limit: limit, N: n}})
 	if err != nil {
-		next := time.Now().Add(time.Second)
-		s.retryAfter = &next
 		return false, 0, time.Time{}, err
 	}
+	return results[0].Taken, results[0].Remaining, results[0].Reset, nil
+}
 
-	// Bucket is full.
-	if bucketLen >= s.rate {
-		return false, 0, time.Time{}, nil
+// TakeBatch implements BatchTokenBucketStore interface. It takes tokens
+// from all of the buckets, if available in each of them. It returns as
+// soon as ctx is done, without waiting for Redis to reply.
+func (s *bucketStore) TakeBatch(ctx context.Context, takes []ratelimit.TakeRequest) ([]ratelimit.TakeResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	if bucketLen > 0 {
-		// Bucket most probably exists, try to push a new token into it.
-		// If RPUSHX returns 0 (ie. key expired between LLEN and RPUSHX), we need
-		// to fall-back to RPUSH without returning error.
-		c.Send("MULTI")
-		c.Send("RPUSHX", PrefixKey+key, "")
-		reply, err := redis.Ints(c.Do("EXEC"))
-		if err != nil {
-			next := time.Now().Add(time.Second)
-			s.retryAfter = &next
-			return false, 0, time.Time{}, err
-		}
-		bucketLen = reply[0]
-		if bucketLen > 0 {
-			return true, s.rate - bucketLen - 1, time.Time{}, nil
+	type reply struct {
+		results []ratelimit.TakeResult
+		err     error
+	}
+	done := make(chan reply, 1)
+	go func() {
+		results, err := s.take(takes)
+		done <- reply{results, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-done:
+		return r.results, r.err
+	}
+}
+
+// take runs takeScript.
+func (s *bucketStore) take(takes []ratelimit.TakeRequest) ([]ratelimit.TakeResult, error) {
+	if time.Now().UnixNano() < atomic.LoadInt64(&s.retryAfter) {
+		return nil, ErrUnreachable
+	}
+	c := s.pool.Get()
+	defer c.Close()
+
+	now := time.Now().UnixNano() / int64(time.Microsecond)
+	args := []interface{}{len(takes)}
+	for _, take := range takes {
+		args = append(args, PrefixKey+take.Key)
+	}
+	args = append(args, now)
+	for _, take := range takes {
+		interval := float64(take.Limit.Window/time.Microsecond) / float64(take.Limit.Rate)
+		ttl := int64(math.Ceil(float64(take.Limit.Burst) * interval / 1000))
+		if ttl < 1 {
+			ttl = 1
 		}
+		args = append(args, take.Limit.Burst, interval, ttl, take.N)
 	}
 
-	c.Send("MULTI")
-	c.Send("RPUSH", PrefixKey+key, "")
-	c.Send("EXPIRE", PrefixKey+key, s.windowSeconds)
-	if _, err := c.Do("EXEC"); err != nil {
-		next := time.Now().Add(time.Second)
-		s.retryAfter = &next
-		return false, 0, time.Time{}, err
+	reply, err := redis.Ints(takeScript.Do(c, args...))
+	if err != nil {
+		return nil, s.fail(err)
 	}
 
-	return true, s.rate - bucketLen - 1, time.Time{}, nil
+	results := make([]ratelimit.TakeResult, len(takes))
+	for i := range results {
+		results[i] = ratelimit.TakeResult{
+			Taken:     reply[i*3] == 1,
+			Remaining: reply[i*3+1],
+			Reset:     time.Unix(0, now*int64(time.Microsecond)).Add(time.Duration(reply[i*3+2]) * time.Microsecond),
+		}
+	}
+	return results, nil
+}
+
+// fail marks redis as unhealthy for a while.
+func (s *bucketStore) fail(err error) error {
+	atomic.StoreInt64(&s.retryAfter, time.Now().Add(RetryAfter).UnixNano())
+	return err
 }
@@ -0,0 +1,66 @@
+package redis
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+type tatStore struct {
+	pool *redis.Pool
+}
+
+// NewTATStore creates new Redis store of theoretical arrival times,
+// ie. for the gcra package. Each TAT is stored as a single key, which
+// expires once the TAT is in the past.
+func NewTATStore(pool *redis.Pool) *tatStore {
+	return &tatStore{
+		pool: pool,
+	}
+}
+
+// advanceScript advances TAT stored in microseconds, as gcra.TATStore does.
+//
+// ARGV holds the current time, the increment and the tolerance, all of them
+// in microseconds. It returns the stored TAT and whether it was advanced.
+var advanceScript = redis.NewScript(1, `
+local now = tonumber(ARGV[1])
+local increment = tonumber(ARGV[2])
+local tolerance = tonumber(ARGV[3])
+
+local tat = tonumber(redis.call("GET", KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local new = tat + increment
+if new - now > tolerance then
+	return {tat, 0}
+end
+
+redis.call("SET", KEYS[1], string.format("%.0f", new), "PX", math.max(1, math.ceil((new - now) / 1000)))
+return {new, 1}
+`)
+
+// Advance implements gcra.TATStore interface.
+func (s *tatStore) Advance(key string, now time.Time, increment, tolerance time.Duration) (time.Time, bool, error) {
+	c := s.pool.Get()
+	defer c.Close()
+
+	reply, err := redis.Values(advanceScript.Do(c, PrefixKey+key,
+		now.UnixNano()/int64(time.Microsecond),
+		float64(increment)/float64(time.Microsecond),
+		float64(tolerance)/float64(time.Microsecond),
+	))
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	tat, err := redis.Int64(reply[0], nil)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	ok, err := redis.Bool(reply[1], nil)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(0, tat*int64(time.Microsecond)), ok, nil
+}
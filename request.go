@@ -8,37 +8,132 @@ import (
 
 func Request(keyFn KeyFn) *requestBuilder {
 	return &requestBuilder{
-		keyFn: keyFn,
+		policies:  []*policy{{keyFn: keyFn}},
+		onLimited: statusHandler(http.StatusTooManyRequests),
+		headers:   LegacyHeaders,
 	}
 }
 
 type requestBuilder struct {
-	keyFn       KeyFn
-	rate        int
-	window      time.Duration
-	rateHeader  string
-	resetHeader string
+	policies  []*policy
+	costFn    func(r *http.Request) int
+	maxDelay  time.Duration
+	onLimited http.Handler
+	headers   HeaderFormat
+	name      string
+}
+
+// policy limits requests with the same key.
+type policy struct {
+	keyFn  KeyFn
+	limit  Limit
+	rateFn func(r *http.Request, key string) (rate int, window time.Duration)
+}
+
+// limitFor returns limit of a given request.
+func (p *policy) limitFor(r *http.Request, key string) Limit {
+	limit := p.limit
+	if p.rateFn != nil {
+		limit.Rate, limit.Window = p.rateFn(r, key)
+	}
+	if limit.Burst <= 0 {
+		limit.Burst = limit.Rate
+	}
+	return limit
+}
+
+// last returns the policy being built.
+func (b *requestBuilder) last() *policy {
+	return b.policies[len(b.policies)-1]
 }
 
 func (b *requestBuilder) Rate(rate int, window time.Duration) *requestBuilder {
-	b.rate = rate
-	b.window = window
-	b.rateHeader = fmt.Sprintf("%v", float32(rate)*float32(window/time.Second))
-	b.resetHeader = fmt.Sprintf("%d", time.Now().Unix())
+	p := b.last()
+	p.limit.Rate = rate
+	p.limit.Window = window
 	return b
 }
 
-// TODO: Custom burst?
-// func (b *requestBuilder) Burst(burst int) *requestBuilder {}
+// RateFn sets a function returning rate per window for a given request
+// and key, ie. depending on the customer's plan. Keys with zero rate are
+// not limited. Overrides Rate.
+func (b *requestBuilder) RateFn(rateFn func(r *http.Request, key string) (rate int, window time.Duration)) *requestBuilder {
+	b.last().rateFn = rateFn
+	return b
+}
+
+// Burst sets the maximum number of tokens a bucket can hold, ie. how far
+// a client can go over the steady rate in a short period of time.
+// Defaults to rate.
+func (b *requestBuilder) Burst(burst int) *requestBuilder {
+	b.last().limit.Burst = burst
+	return b
+}
+
+// And adds another policy limiting requests by a given key. The following
+// Rate and Burst apply to the new policy. The request is rejected if any
+// of the policies is exceeded. All of the policies are evaluated by a single
+// call to the store, which must implement BatchTokenBucketStore.
+func (b *requestBuilder) And(keyFn KeyFn) *requestBuilder {
+	b.policies = append(b.policies, &policy{keyFn: keyFn})
+	return b
+}
+
+// Cost sets a function returning number of tokens a request takes from
+// the bucket, so expensive requests drain the bucket faster than cheap
+// ones. Requests with zero cost are not limited. Requests costing more
+// than burst are always rejected. Defaults to 1 token per request.
+func (b *requestBuilder) Cost(costFn func(r *http.Request) int) *requestBuilder {
+	b.costFn = costFn
+	return b
+}
+
+// Wait makes the requests wait for the tokens instead of being rejected
+// right away, as long as the tokens are expected to become available
+// within maxDelay. Useful for internal traffic, where queueing is
+// preferred over retrying.
+func (b *requestBuilder) Wait(maxDelay time.Duration) *requestBuilder {
+	b.maxDelay = maxDelay
+	return b
+}
+
+// OnLimited sets a handler serving the rejected requests, ie. to render
+// a custom error body. The handler can get the details of the limit by
+// StatusFromContext. Defaults to plain 429 Too Many Requests response.
+func (b *requestBuilder) OnLimited(h http.Handler) *requestBuilder {
+	b.onLimited = h
+	return b
+}
+
+// Headers sets the format of the rate limit headers, ie. IETFHeaders or
+// LegacyHeaders|IETFHeaders to send both. Defaults to LegacyHeaders.
+func (b *requestBuilder) Headers(format HeaderFormat) *requestBuilder {
+	b.headers = format
+	return b
+}
+
+// Name sets the namespace of the limiter's buckets in the store. Limiters
+// sharing the store have buckets of their own, unless they have the same
+// name, ie. the same limiter run by multiple processes sharing Redis.
+// Defaults to the function and line calling LimitBy, which match among
+// processes running the same code, but change as the code does.
+func (b *requestBuilder) Name(name string) *requestBuilder {
+	b.name = name
+	return b
+}
 
 func (b *requestBuilder) LimitBy(store TokenBucketStore, fallbackStores ...TokenBucketStore) func(http.Handler) http.Handler {
-	store.InitRate(b.rate, b.window)
-	for _, store := range fallbackStores {
-		store.InitRate(b.rate, b.window)
+	if len(b.policies) > 1 {
+		for _, store := range append([]TokenBucketStore{store}, fallbackStores...) {
+			if _, ok := store.(BatchTokenBucketStore); !ok {
+				panic("LimitBy expects BatchTokenBucketStore for multiple policies")
+			}
+		}
 	}
 
 	limiter := requestLimiter{
 		requestBuilder: b,
+		namespace:      namespace(b.name),
 		store:          store,
 		fallbackStores: fallbackStores,
 	}
@@ -55,41 +150,128 @@ type requestLimiter struct {
 	*requestBuilder
 
 	next           http.Handler
+	namespace      string
 	store          TokenBucketStore
 	fallbackStores []TokenBucketStore
 }
 
 // ServeHTTPC implements http.Handler interface.
 func (l *requestLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	key := l.keyFn(r)
-	if key == "" {
+	cost := 1
+	if l.costFn != nil {
+		cost = l.costFn(r)
+	}
+	if cost <= 0 {
 		l.next.ServeHTTP(w, r)
 		return
 	}
 
-	ok, remaining, reset, err := l.store.Take("request:" + key)
-	if err != nil {
-		for _, store := range l.fallbackStores {
-			ok, remaining, reset, err = store.Take("request:" + key)
-			if err == nil {
-				break
-			}
+	var (
+		keys  []string
+		takes []TakeRequest
+	)
+	for i, p := range l.policies {
+		key := p.keyFn(r)
+		if key == "" {
+			continue
+		}
+		limit := p.limitFor(r, key)
+		if limit.Rate <= 0 {
+			continue
+		}
+		// Buckets of different limiters, policies and limits must not
+		// collide, even if they share the store.
+		bucket := fmt.Sprintf("request:%s:%d:%v:%s", l.namespace, i, limit, key)
+		keys = append(keys, key)
+		takes = append(takes, TakeRequest{Key: bucket, Limit: limit, N: cost})
+	}
+	if len(takes) == 0 {
+		l.next.ServeHTTP(w, r)
+		return
+	}
+
+	var (
+		results []TakeResult
+		i       int
+		ok      bool
+		err     error
+	)
+	deadline := time.Now().Add(l.maxDelay)
+	wait := true
+	for _, take := range takes {
+		// The bucket never holds enough tokens, no point in waiting.
+		if take.N > take.Limit.Burst {
+			wait = false
+		}
+	}
+	for {
+		results, err = l.take(r, takes)
+		if err != nil {
+			break
+		}
+		i, ok = restrictive(results)
+		if ok || !wait || results[i].Reset.After(deadline) {
+			break
+		}
+		// Wait for the tokens, the client is willing to wait that long.
+		if !sleep(r.Context(), results[i].Reset.Sub(time.Now())) {
+			return
 		}
 	}
 	if err != nil {
+		// Client has gone away.
+		if r.Context().Err() != nil {
+			return
+		}
 		l.next.ServeHTTP(w, r)
 		return
 	}
+
+	status := Status{
+		Key:       keys[i],
+		Limit:     takes[i].Limit.Burst,
+		Remaining: results[i].Remaining,
+		Reset:     results[i].Reset,
+	}
+	writeHeaders(w.Header(), l.headers, status, takes[i].Limit)
 	if !ok {
-		w.Header().Add("Retry-After", reset.Format(http.TimeFormat))
-		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", seconds(status.Reset.Sub(time.Now()))))
+		limited(l.onLimited, w, r, status)
 		return
 	}
-	w.Header().Add("X-RateLimit-Key", key)
-	w.Header().Add("X-RateLimit-Rate", l.rateHeader)
-	w.Header().Add("X-RateLimit-Limit", fmt.Sprintf("%d", l.rate))
-	w.Header().Add("X-RateLimit-Remaining", fmt.Sprintf("%d", remaining))
-	w.Header().Add("X-RateLimit-Reset", fmt.Sprintf("%d", reset.Unix()))
-	w.Header().Add("Retry-After", reset.Format(http.TimeFormat))
 	l.next.ServeHTTP(w, r)
 }
+
+// take takes the tokens of all policies.
+func (l *requestLimiter) take(r *http.Request, takes []TakeRequest) ([]TakeResult, error) {
+	if len(l.policies) > 1 {
+		return takeBatch(r.Context(), l.store, l.fallbackStores, takes)
+	}
+
+	taken, remaining, reset, err := take(r.Context(), l.store, l.fallbackStores, takes[0].Key, takes[0].Limit, takes[0].N)
+	return []TakeResult{{Taken: taken, Remaining: remaining, Reset: reset}}, err
+}
+
+// restrictive returns index of the most restrictive result, ie. the one
+// which takes the longest to get the tokens or the one with the least
+// remaining tokens, and whether all of the tokens were taken.
+func restrictive(results []TakeResult) (int, bool) {
+	i := 0
+	for j, result := range results {
+		switch {
+		case result.Taken != results[i].Taken:
+			if !result.Taken {
+				i = j
+			}
+		case !result.Taken:
+			if result.Reset.After(results[i].Reset) {
+				i = j
+			}
+		default:
+			if result.Remaining < results[i].Remaining {
+				i = j
+			}
+		}
+	}
+	return i, results[i].Taken
+}
@@ -1,7 +1,11 @@
 package ratelimit_test
 
 import (
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
 	"time"
 
 	"github.com/VojtechVitek/ratelimit"
@@ -9,7 +13,7 @@ import (
 )
 
 func ExampleRequest() {
-	middleware := ratelimit.Request(ratelimit.IP).Rate(30, time.Minute).LimitBy(memory.New())
+	middleware := ratelimit.Request(ratelimit.IP).Rate(30, time.Minute).Burst(10).LimitBy(memory.New())
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World!"))
@@ -17,3 +21,242 @@ func ExampleRequest() {
 
 	http.ListenAndServe(":3333", middleware(handler))
 }
+
+func ExampleRequest_cost() {
+	// Exports drain the bucket ten times faster than other requests.
+	cost := func(r *http.Request) int {
+		if r.URL.Path == "/export" {
+			return 10
+		}
+		return 1
+	}
+	middleware := ratelimit.Request(ratelimit.IP).Rate(1000, time.Hour).Cost(cost).LimitBy(memory.New())
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello World!"))
+	})
+
+	http.ListenAndServe(":3333", middleware(handler))
+}
+
+func ExampleRequest_wait() {
+	// Internal clients rather wait up to a second than retry.
+	middleware := ratelimit.Request(ratelimit.IP).Rate(100, time.Second).Wait(time.Second).LimitBy(memory.New())
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello World!"))
+	})
+
+	http.ListenAndServe(":3333", middleware(handler))
+}
+
+func ExampleRequest_onLimited() {
+	problem := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := ratelimit.StatusFromContext(r.Context())
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, `{"title": "Too Many Requests", "status": 429, "limit": %d, "reset": %d}`, status.Limit, status.Reset.Unix())
+	})
+	middleware := ratelimit.Request(ratelimit.IP).Rate(30, time.Minute).OnLimited(problem).LimitBy(memory.New())
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello World!"))
+	})
+
+	http.ListenAndServe(":3333", middleware(handler))
+}
+
+func ExampleRequest_and() {
+	apiKey := func(r *http.Request) string {
+		return r.Header.Get("X-API-Key")
+	}
+	tenant := func(r *http.Request) string {
+		return r.Header.Get("X-Tenant")
+	}
+
+	// 100/min per IP and 1000/min per API key and 10000/min per tenant.
+	middleware := ratelimit.Request(ratelimit.IP).Rate(100, time.Minute).
+		And(apiKey).Rate(1000, time.Minute).
+		And(tenant).Rate(10000, time.Minute).
+		LimitBy(memory.New())
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello World!"))
+	})
+
+	http.ListenAndServe(":3333", middleware(handler))
+}
+
+// customerKey is the context key of the customer ID, set by authentication
+// middleware. It's unexported, so other packages can't collide with it.
+type customerKey struct{}
+
+func ExampleRequest_rateFn() {
+	// Plans of the customers, ie. loaded from the database.
+	plans := map[string]string{"acme": "pro"}
+
+	// Customer ID is set by the authentication middleware, so it can't be
+	// picked by the client. Unknown plans fall back to the free one.
+	customer := ratelimit.ContextValue(customerKey{})
+	rateFn := func(r *http.Request, customer string) (int, time.Duration) {
+		if plans[customer] == "pro" {
+			return 600, time.Minute
+		}
+		return 60, time.Minute
+	}
+	middleware := ratelimit.Request(customer).RateFn(rateFn).LimitBy(memory.New())
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello World!"))
+	})
+
+	http.ListenAndServe(":3333", middleware(handler))
+}
+
+func TestRequestCostOverBurst(t *testing.T) {
+	cost := func(r *http.Request) int {
+		return 20
+	}
+	middleware := ratelimit.Request(ratelimit.IP).Rate(10, time.Second).Cost(cost).Wait(2 * time.Second).LimitBy(memory.New())
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("request costing more than burst waited %v", elapsed)
+	}
+}
+
+func sharedLimiter(store ratelimit.TokenBucketStore) func(http.Handler) http.Handler {
+	return ratelimit.Request(ratelimit.IP).Rate(5, time.Minute).LimitBy(store)
+}
+
+func TestRequestSharedStore(t *testing.T) {
+	store := memory.New()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		login, reset http.Handler
+		want         int
+	}{
+		// Limiters sharing the store have buckets of their own.
+		{
+			login: ratelimit.Request(ratelimit.IP).Rate(5, time.Minute).LimitBy(store)(ok),
+			reset: ratelimit.Request(ratelimit.IP).Rate(5, time.Minute).LimitBy(store)(ok),
+			want:  http.StatusOK,
+		},
+		// Limiters created by the same code share their buckets, ie. in
+		// replicas sharing Redis.
+		{
+			login: sharedLimiter(store)(ok),
+			reset: sharedLimiter(store)(ok),
+			want:  http.StatusTooManyRequests,
+		},
+		// Limiters of the same name share their buckets.
+		{
+			login: ratelimit.Request(ratelimit.IP).Rate(5, time.Minute).Name("auth").LimitBy(store)(ok),
+			reset: ratelimit.Request(ratelimit.IP).Rate(5, time.Minute).Name("auth").LimitBy(store)(ok),
+			want:  http.StatusTooManyRequests,
+		},
+	}
+	for i, tt := range tests {
+		for j := 0; j < 5; j++ {
+			tt.login.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/login", nil))
+		}
+		w := httptest.NewRecorder()
+		tt.reset.ServeHTTP(w, httptest.NewRequest("GET", "/reset", nil))
+		if w.Code != tt.want {
+			t.Errorf("%d: got status %d, want %d", i, w.Code, tt.want)
+		}
+	}
+}
+
+func TestRequestPolicies(t *testing.T) {
+	cost := func(r *http.Request) int {
+		n, _ := strconv.Atoi(r.Header.Get("X-Cost"))
+		return n
+	}
+	middleware := ratelimit.Request(ratelimit.Header("X-User")).Rate(10, time.Minute).
+		And(ratelimit.IP).Rate(6, time.Minute).
+		Cost(cost).
+		Headers(ratelimit.LegacyHeaders | ratelimit.IETFHeaders).
+		LimitBy(memory.New())
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// The headers describe the most restrictive policy, ie. the rejecting
+	// one or the one with the least remaining tokens.
+	tests := []struct {
+		ip        string
+		cost      int
+		status    int
+		key       string
+		remaining string
+		policy    string
+	}{
+		{ip: "192.0.2.1", cost: 1, status: 200, key: "192.0.2.1", remaining: "5", policy: "6;w=60"},
+		{ip: "192.0.2.1", cost: 5, status: 200, key: "192.0.2.1", remaining: "0", policy: "6;w=60"},
+		// Rejected by the IP policy, the user policy is not charged either.
+		{ip: "192.0.2.1", cost: 1, status: 429, key: "192.0.2.1", remaining: "0", policy: "6;w=60"},
+		{ip: "192.0.2.2", cost: 2, status: 200, key: "alice", remaining: "2", policy: "10;w=60"},
+		{ip: "192.0.2.2", cost: 3, status: 429, key: "alice", remaining: "2", policy: "10;w=60"},
+		// Requests with zero cost are not limited.
+		{ip: "192.0.2.1", cost: 0, status: 200},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.ip + ":1234"
+		r.Header.Set("X-User", "alice")
+		r.Header.Set("X-Cost", strconv.Itoa(tt.cost))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		h := w.Header()
+		if w.Code != tt.status {
+			t.Errorf("%d: got status %d, want %d", i, w.Code, tt.status)
+		}
+		if got := h.Get("X-RateLimit-Key"); got != tt.key {
+			t.Errorf("%d: got key %q, want %q", i, got, tt.key)
+		}
+		if got := h.Get("X-RateLimit-Remaining"); got != tt.remaining {
+			t.Errorf("%d: got remaining %q, want %q", i, got, tt.remaining)
+		}
+		if got := h.Get("RateLimit-Policy"); got != tt.policy {
+			t.Errorf("%d: got policy %q, want %q", i, got, tt.policy)
+		}
+		if got := h.Get("Retry-After"); (got != "") != (tt.status == 429) {
+			t.Errorf("%d: got Retry-After %q with status %d", i, got, w.Code)
+		}
+	}
+}
+
+func TestRequestStoreFull(t *testing.T) {
+	store := memory.New(memory.MaxKeys(1))
+	fallback := memory.New()
+	middleware := ratelimit.Request(ratelimit.IP).Rate(1, time.Hour).LimitBy(store, fallback)
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// The new client is limited by the fallback store, while the store
+	// is full of buckets of the other clients.
+	tests := []struct {
+		ip   string
+		want int
+	}{
+		{ip: "192.0.2.1", want: http.StatusOK},
+		{ip: "192.0.2.2", want: http.StatusOK},
+		{ip: "192.0.2.2", want: http.StatusTooManyRequests},
+		{ip: "192.0.2.1", want: http.StatusTooManyRequests},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.ip + ":1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%d: got status %d, want %d", i, w.Code, tt.want)
+		}
+	}
+}
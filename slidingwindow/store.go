@@ -0,0 +1,96 @@
+// Package slidingwindow implements sliding window counter algorithm on top
+// of any storage able to keep counters, ie. Redis or In-Memory.
+//
+// The number of requests made within the last window is estimated from
+// the count of the current fixed window and the count of the previous one,
+// weighted by the fraction of the previous window that overlaps the sliding
+// one. Unlike fixed windows, this doesn't let a client send twice the rate
+// across a window boundary.
+package slidingwindow
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/VojtechVitek/ratelimit"
+)
+
+// CounterStore is an interface for any storage of window counters.
+type CounterStore interface {
+	// Incr adds n to the counter referenced by key and returns its new
+	// value together with the value of the counter referenced by prevKey.
+	// The counter referenced by key shall expire after ttl.
+	Incr(key string, prevKey string, n int, ttl time.Duration) (prev int, curr int, err error)
+}
+
+type bucketStore struct {
+	counters CounterStore
+}
+
+// New creates new sliding window store backed by a given counter store.
+func New(counters CounterStore) *bucketStore {
+	return &bucketStore{
+		counters: counters,
+	}
+}
+
+// Take implements TokenBucketStore interface. It counts n requests in
+// the window referenced by a given key, if the rate allows it. Sliding
+// window has no notion of burst, the rate is never exceeded within any
+// window.
+func (s *bucketStore) Take(key string, limit ratelimit.Limit, n int) (bool, int, time.Time, error) {
+	now := time.Now()
+	i := now.UnixNano() / int64(limit.Window)
+	start := time.Unix(0, i*int64(limit.Window))
+	currKey := fmt.Sprintf("%s:%d", key, i)
+	prevKey := fmt.Sprintf("%s:%d", key, i-1)
+
+	prev, curr, err := s.counters.Incr(currKey, prevKey, n, 2*limit.Window)
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+
+	count := estimate(limit.Window, start, now, prev, curr)
+	if count > float64(limit.Rate) {
+		// Don't count rejected requests.
+		if _, curr, err = s.counters.Incr(currKey, prevKey, -n, 2*limit.Window); err != nil {
+			return false, 0, time.Time{}, err
+		}
+		return false, 0, until(limit.Window, start, prev, curr, float64(limit.Rate-n)), nil
+	}
+
+	return true, int(float64(limit.Rate) - count), until(limit.Window, start, prev, curr, count-1), nil
+}
+
+// estimate returns number of requests made within the sliding window
+// ending at now.
+func estimate(window time.Duration, start, now time.Time, prev, curr int) float64 {
+	overlap := 1 - float64(now.Sub(start))/float64(window)
+	return float64(prev)*overlap + float64(curr)
+}
+
+// until returns time at which the estimated number of requests drops
+// to a given count.
+func until(window time.Duration, start time.Time, prev, curr int, count float64) time.Time {
+	// Within the current window, the previous count fades out.
+	if float64(curr) <= count {
+		elapsed := 1.0
+		if prev > 0 {
+			elapsed = 1 - (count-float64(curr))/float64(prev)
+		}
+		return start.Add(fraction(window, elapsed))
+	}
+
+	// Within the next window, the current count fades out.
+	elapsed := 1.0
+	if curr > 0 && count > 0 {
+		elapsed = 1 - count/float64(curr)
+	}
+	return start.Add(window).Add(fraction(window, elapsed))
+}
+
+// fraction returns a given fraction of the window.
+func fraction(window time.Duration, f float64) time.Duration {
+	return time.Duration(math.Max(0, math.Min(1, f)) * float64(window))
+}
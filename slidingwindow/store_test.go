@@ -0,0 +1,21 @@
+package slidingwindow_test
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/VojtechVitek/ratelimit"
+	"github.com/VojtechVitek/ratelimit/memory"
+	"github.com/VojtechVitek/ratelimit/slidingwindow"
+)
+
+func ExampleNew() {
+	store := slidingwindow.New(memory.NewCounterStore())
+	middleware := ratelimit.Request(ratelimit.IP).Rate(30, time.Minute).LimitBy(store)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello World!"))
+	})
+
+	http.ListenAndServe(":3333", middleware(handler))
+}
@@ -0,0 +1,109 @@
+package slidingwindow
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/VojtechVitek/ratelimit"
+	"github.com/VojtechVitek/ratelimit/memory"
+)
+
+func TestTake(t *testing.T) {
+	limit := ratelimit.Limit{Rate: 10, Window: time.Hour}
+
+	tests := []struct {
+		prev int // requests made within the previous window
+	}{
+		{prev: 0},
+		{prev: 4},
+		{prev: 10},
+		{prev: 30},
+	}
+	for i, tt := range tests {
+		counters := memory.NewCounterStore()
+		store := New(counters)
+
+		now := time.Now()
+		w := now.UnixNano() / int64(limit.Window)
+		start := time.Unix(0, w*int64(limit.Window))
+		if _, _, err := counters.Incr(fmt.Sprintf("key:%d", w-1), "", tt.prev, 2*limit.Window); err != nil {
+			t.Fatal(err)
+		}
+
+		// The previous requests count by the fraction of the previous window
+		// overlapping the sliding one.
+		weighted := float64(tt.prev) * (1 - float64(now.Sub(start))/float64(limit.Window))
+		want := int(math.Max(0, math.Floor(float64(limit.Rate)-weighted)))
+
+		taken := 0
+		for {
+			ok, remaining, reset, err := store.Take("key", limit, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				if remaining != 0 || !reset.After(now) {
+					t.Errorf("%d: got remaining %d, reset %v once limited", i, remaining, reset)
+				}
+				break
+			}
+			taken++
+			if left := want - taken; remaining != left {
+				t.Errorf("%d: got remaining %d after %d takes, want %d", i, remaining, taken, left)
+			}
+		}
+		if taken != want {
+			t.Errorf("%d: got %d takes, want %d", i, taken, want)
+		}
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	window := 10 * time.Second
+	start := time.Unix(1000, 0)
+
+	tests := []struct {
+		elapsed    time.Duration
+		prev, curr int
+		want       float64
+	}{
+		{elapsed: 0, prev: 10, curr: 0, want: 10},
+		{elapsed: 2500 * time.Millisecond, prev: 10, curr: 2, want: 9.5},
+		{elapsed: 5 * time.Second, prev: 4, curr: 3, want: 5},
+		{elapsed: 10 * time.Second, prev: 10, curr: 7, want: 7},
+		{elapsed: 5 * time.Second, prev: 0, curr: 3, want: 3},
+	}
+	for i, tt := range tests {
+		if got := estimate(window, start, start.Add(tt.elapsed), tt.prev, tt.curr); got != tt.want {
+			t.Errorf("%d: got estimate %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestUntil(t *testing.T) {
+	window := 10 * time.Second
+	start := time.Unix(1000, 0)
+
+	tests := []struct {
+		prev, curr int
+		count      float64
+		want       time.Duration // since the start of the current window
+	}{
+		// The previous count fades out within the current window.
+		{prev: 10, curr: 2, count: 5, want: 7 * time.Second},
+		{prev: 10, curr: 2, count: 2, want: 10 * time.Second},
+		{prev: 10, curr: 0, count: 5, want: 5 * time.Second},
+		// The current count fades out within the next window.
+		{prev: 10, curr: 8, count: 5, want: 13750 * time.Millisecond},
+		{prev: 10, curr: 2, count: 1.5, want: 12500 * time.Millisecond},
+		{prev: 0, curr: 3, count: 2, want: 13333333333},
+		{prev: 10, curr: 8, count: 0, want: 20 * time.Second},
+	}
+	for i, tt := range tests {
+		if got := until(window, start, tt.prev, tt.curr, tt.count).Sub(start); got != tt.want {
+			t.Errorf("%d: got reset in %v, want %v", i, got, tt.want)
+		}
+	}
+}
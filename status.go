@@ -0,0 +1,38 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Status describes the limit a request was rejected by.
+type Status struct {
+	Key       string
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+type statusKey struct{}
+
+// StatusFromContext returns the status of the limit the request was
+// rejected by. It's available to the OnLimited handlers.
+func StatusFromContext(ctx context.Context) (Status, bool) {
+	status, ok := ctx.Value(statusKey{}).(Status)
+	return status, ok
+}
+
+// limited serves the rejected request by a given handler, passing
+// the status along in the request context.
+func limited(h http.Handler, w http.ResponseWriter, r *http.Request, status Status) {
+	h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), statusKey{}, status)))
+}
+
+// statusHandler responds with a given HTTP status code.
+type statusHandler int
+
+// ServeHTTP implements http.Handler interface.
+func (code statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, http.StatusText(int(code)), int(code))
+}
@@ -1,27 +1,63 @@
 package ratelimit
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+)
 
 // Throttle is a middleware that limits number of currently
 // processed requests at a time.
 func Throttle(limit int) func(http.Handler) http.Handler {
+	return ThrottleBy(limit).Handler
+}
+
+// ThrottleBy is like Throttle, but it returns a builder to configure
+// the waiting and the rejected requests, ie.
+// ThrottleBy(10).Wait(time.Second).Handler.
+func ThrottleBy(limit int) *throttleBuilder {
 	if limit <= 0 {
 		panic("Throttle expects limit > 0")
 	}
 
+	return &throttleBuilder{
+		limit:     limit,
+		onLimited: statusHandler(http.StatusServiceUnavailable),
+	}
+}
+
+type throttleBuilder struct {
+	limit     int
+	maxDelay  time.Duration
+	onLimited http.Handler
+}
+
+// Wait sets the maximum time a request waits for its turn before it's
+// rejected. By default, requests wait for as long as the client does.
+func (b *throttleBuilder) Wait(maxDelay time.Duration) *throttleBuilder {
+	b.maxDelay = maxDelay
+	return b
+}
+
+// OnLimited sets a handler serving the rejected requests, ie. to render
+// a custom error body. The handler can get the details of the limit by
+// StatusFromContext. Defaults to plain 503 Service Unavailable response.
+func (b *throttleBuilder) OnLimited(h http.Handler) *throttleBuilder {
+	b.onLimited = h
+	return b
+}
+
+// Handler is the middleware.
+func (b *throttleBuilder) Handler(h http.Handler) http.Handler {
 	t := throttler{
-		tokens: make(chan token, limit),
+		throttleBuilder: b,
+		h:               h,
+		tokens:          make(chan token, b.limit),
 	}
-	for i := 0; i < limit; i++ {
+	for i := 0; i < b.limit; i++ {
 		t.tokens <- token{}
 	}
 
-	fn := func(h http.Handler) http.Handler {
-		t.h = h
-		return &t
-	}
-
-	return fn
+	return &t
 }
 
 // token represents a request that is being processed.
@@ -29,15 +65,28 @@ type token struct{}
 
 // throttler limits number of currently processed requests at a time.
 type throttler struct {
+	*throttleBuilder
+
 	h      http.Handler
 	tokens chan token
 }
 
 // ServeHTTP implements http.Handler interface.
 func (t *throttler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var timeout <-chan time.Time
+	if t.maxDelay > 0 {
+		timer := time.NewTimer(t.maxDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
 	select {
 	case <-r.Context().Done():
 		return
+	case <-timeout:
+		limited(t.onLimited, w, r, Status{
+			Limit: t.limit,
+		})
 	case tok := <-t.tokens:
 		defer func() {
 			t.tokens <- tok
@@ -1,6 +1,7 @@
 package ratelimit_test
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
@@ -21,3 +22,20 @@ func ExampleThrottle() {
 
 	http.ListenAndServe(":3333", middleware(handler))
 }
+
+func ExampleThrottleBy() {
+	// Reject requests waiting for more than a second with JSON error.
+	middleware := ratelimit.ThrottleBy(10).Wait(time.Second).OnLimited(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := ratelimit.StatusFromContext(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, `{"error": "over capacity", "limit": %d}`, status.Limit)
+	})).Handler
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Second)
+		w.Write([]byte("done"))
+	})
+
+	http.ListenAndServe(":3333", middleware(handler))
+}
@@ -0,0 +1,145 @@
+package ratelimit
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// UploadSpeed limits the speed of reading request bodies, ie. file uploads,
+// the same way DownloadSpeed limits writing responses.
+func UploadSpeed(keyFn KeyFn) *uploadBuilder {
+	return &uploadBuilder{
+		keyFn: keyFn,
+	}
+}
+
+type uploadBuilder struct {
+	keyFn  KeyFn
+	rate   int
+	window time.Duration
+	burst  int
+	chunk  int
+	name   string
+}
+
+// Rate sets the speed in bytes per window, ie. Rate(ratelimit.MiB, time.Second).
+func (b *uploadBuilder) Rate(rate int, window time.Duration) *uploadBuilder {
+	b.rate = rate
+	b.window = window
+	return b
+}
+
+// Burst sets the maximum number of bytes a bucket can hold, ie. how far
+// a client can go over the steady rate in a short period of time.
+// Defaults to rate.
+func (b *uploadBuilder) Burst(burst int) *uploadBuilder {
+	b.burst = burst
+	return b
+}
+
+// Chunk sets the number of bytes worth waiting for once the bucket is empty,
+// ie. the granularity of the pacing. Smaller chunks make the transfer smoother
+// at the cost of more calls to the store. Defaults to 32 KiB.
+func (b *uploadBuilder) Chunk(size int) *uploadBuilder {
+	b.chunk = size
+	return b
+}
+
+// Name sets the namespace of the limiter's buckets in the store. Limiters
+// sharing the store have buckets of their own, unless they have the same
+// name, ie. the same limiter run by multiple processes sharing Redis.
+// Defaults to the function and line calling LimitBy, which match among
+// processes running the same code, but change as the code does.
+func (b *uploadBuilder) Name(name string) *uploadBuilder {
+	b.name = name
+	return b
+}
+
+func (b *uploadBuilder) LimitBy(store TokenBucketStore, fallbackStores ...TokenBucketStore) func(http.Handler) http.Handler {
+	if b.rate <= 0 || b.window <= 0 {
+		panic("LimitBy expects Rate with rate > 0 and window > 0")
+	}
+
+	limit := Limit{Rate: b.rate, Window: b.window, Burst: b.burst}
+	if limit.Burst <= 0 {
+		limit.Burst = limit.Rate
+	}
+	chunk := b.chunk
+	if chunk <= 0 {
+		chunk = defaultChunk
+	}
+
+	uploadLimiter := uploadLimiter{
+		uploadBuilder:  b,
+		limit:          limit,
+		chunk:          chunk,
+		namespace:      namespace(b.name),
+		store:          store,
+		fallbackStores: fallbackStores,
+	}
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			key := uploadLimiter.keyFn(r)
+			if key == "" || r.Body == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			r.Body = &limitReader{
+				ReadCloser: r.Body,
+				pacer:      uploadLimiter.pacer(r, key),
+				left:       r.ContentLength,
+			}
+
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+type uploadLimiter struct {
+	*uploadBuilder
+
+	limit          Limit
+	chunk          int
+	namespace      string
+	store          TokenBucketStore
+	fallbackStores []TokenBucketStore
+}
+
+// pacer returns pacer of a given request.
+func (l *uploadLimiter) pacer(r *http.Request, key string) pacer {
+	return newPacer(r.Context(), l.store, l.fallbackStores, "upload:"+l.namespace+":"+l.limit.String()+":"+key, l.limit, l.chunk, nil)
+}
+
+type limitReader struct {
+	io.ReadCloser
+	pacer
+
+	left int64 // bytes left to read, or -1 if unknown
+}
+
+func (r *limitReader) Read(buf []byte) (int, error) {
+	// Don't take tokens for more bytes than the body holds.
+	want := len(buf)
+	if r.left >= 0 && int64(want) > r.left {
+		want = int(r.left)
+	}
+	if want == 0 {
+		return r.ReadCloser.Read(buf)
+	}
+
+	max, err := r.reserve(want)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := r.ReadCloser.Read(buf[:max])
+	r.release(n)
+	if r.left >= 0 {
+		r.left -= int64(n)
+	}
+	return n, err
+}
@@ -0,0 +1,88 @@
+package ratelimit_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/VojtechVitek/ratelimit"
+	"github.com/VojtechVitek/ratelimit/memory"
+)
+
+// Watch the upload speed with
+// curl -T /path/to/file http://localhost:3333/upload
+func ExampleUploadSpeed() {
+	middleware := ratelimit.UploadSpeed(ratelimit.IP).Rate(ratelimit.MiB, time.Second).LimitBy(memory.New())
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	})
+
+	http.ListenAndServe(":3333", middleware(handler))
+}
+
+func TestUploadSpeedContentLength(t *testing.T) {
+	store := &takenStore{TokenBucketStore: memory.New()}
+	middleware := ratelimit.UploadSpeed(ratelimit.IP).Rate(ratelimit.MiB, time.Second).LimitBy(store)
+	var read int64
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read, _ = io.Copy(ioutil.Discard, r.Body)
+	}))
+
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(make([]byte, 100)))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if read != 100 {
+		t.Errorf("read %d bytes, want 100", read)
+	}
+	if store.taken != 100 {
+		t.Errorf("took %d tokens, want 100", store.taken)
+	}
+}
+
+func TestUploadSpeedPacing(t *testing.T) {
+	middleware := ratelimit.UploadSpeed(ratelimit.IP).Rate(256*ratelimit.KiB, time.Second).Burst(32 * ratelimit.KiB).Chunk(16 * ratelimit.KiB).LimitBy(memory.New())
+	var read int64
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read, _ = io.Copy(ioutil.Discard, r.Body)
+	}))
+
+	start := time.Now()
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(make([]byte, 160*ratelimit.KiB)))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	elapsed := time.Since(start)
+
+	if read != 160*ratelimit.KiB {
+		t.Errorf("read %d bytes, want %d", read, 160*ratelimit.KiB)
+	}
+	// 128 KiB over the burst at 256 KiB/s.
+	if elapsed < 450*time.Millisecond || elapsed > time.Second {
+		t.Errorf("took %v, want 500ms", elapsed)
+	}
+}
+
+func TestUploadSpeedCancel(t *testing.T) {
+	middleware := ratelimit.UploadSpeed(ratelimit.IP).Rate(ratelimit.KiB, time.Second).Chunk(ratelimit.KiB).LimitBy(memory.New())
+	var err error
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err = io.Copy(ioutil.Discard, r.Body)
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(make([]byte, 10*ratelimit.KiB)))
+	handler.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+
+	if err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("took %v to stop reading", elapsed)
+	}
+}
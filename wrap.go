@@ -0,0 +1,292 @@
+package ratelimit
+
+import (
+	"io"
+	"math"
+	"net/http"
+)
+
+// Optional interfaces of http.ResponseWriter, as a bitmask.
+const (
+	flusher = 1 << iota
+	hijacker
+	closeNotifier
+	readerFrom
+	pusher
+)
+
+// wrap returns w exposing exactly the optional interfaces implemented
+// by the underlying http.ResponseWriter. Writes through io.ReaderFrom
+// are rate limited too, while hijacked connections are not.
+func wrap(w *limitWriter) http.ResponseWriter {
+	var mask int
+	f, ok := w.ResponseWriter.(http.Flusher)
+	if ok {
+		mask |= flusher
+	}
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if ok {
+		mask |= hijacker
+	}
+	c, ok := w.ResponseWriter.(http.CloseNotifier)
+	if ok {
+		mask |= closeNotifier
+	}
+	var r io.ReaderFrom
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		r = &limitReaderFrom{limitWriter: w, ReaderFrom: rf}
+		mask |= readerFrom
+	}
+	p, ok := w.ResponseWriter.(http.Pusher)
+	if ok {
+		mask |= pusher
+	}
+
+	switch mask {
+	case flusher:
+		return struct {
+			*limitWriter
+			http.Flusher
+		}{w, f}
+	case hijacker:
+		return struct {
+			*limitWriter
+			http.Hijacker
+		}{w, h}
+	case flusher | hijacker:
+		return struct {
+			*limitWriter
+			http.Flusher
+			http.Hijacker
+		}{w, f, h}
+	case closeNotifier:
+		return struct {
+			*limitWriter
+			http.CloseNotifier
+		}{w, c}
+	case flusher | closeNotifier:
+		return struct {
+			*limitWriter
+			http.Flusher
+			http.CloseNotifier
+		}{w, f, c}
+	case hijacker | closeNotifier:
+		return struct {
+			*limitWriter
+			http.Hijacker
+			http.CloseNotifier
+		}{w, h, c}
+	case flusher | hijacker | closeNotifier:
+		return struct {
+			*limitWriter
+			http.Flusher
+			http.Hijacker
+			http.CloseNotifier
+		}{w, f, h, c}
+	case readerFrom:
+		return struct {
+			*limitWriter
+			io.ReaderFrom
+		}{w, r}
+	case flusher | readerFrom:
+		return struct {
+			*limitWriter
+			http.Flusher
+			io.ReaderFrom
+		}{w, f, r}
+	case hijacker | readerFrom:
+		return struct {
+			*limitWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{w, h, r}
+	case flusher | hijacker | readerFrom:
+		return struct {
+			*limitWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{w, f, h, r}
+	case closeNotifier | readerFrom:
+		return struct {
+			*limitWriter
+			http.CloseNotifier
+			io.ReaderFrom
+		}{w, c, r}
+	case flusher | closeNotifier | readerFrom:
+		return struct {
+			*limitWriter
+			http.Flusher
+			http.CloseNotifier
+			io.ReaderFrom
+		}{w, f, c, r}
+	case hijacker | closeNotifier | readerFrom:
+		return struct {
+			*limitWriter
+			http.Hijacker
+			http.CloseNotifier
+			io.ReaderFrom
+		}{w, h, c, r}
+	case flusher | hijacker | closeNotifier | readerFrom:
+		return struct {
+			*limitWriter
+			http.Flusher
+			http.Hijacker
+			http.CloseNotifier
+			io.ReaderFrom
+		}{w, f, h, c, r}
+	case pusher:
+		return struct {
+			*limitWriter
+			http.Pusher
+		}{w, p}
+	case flusher | pusher:
+		return struct {
+			*limitWriter
+			http.Flusher
+			http.Pusher
+		}{w, f, p}
+	case hijacker | pusher:
+		return struct {
+			*limitWriter
+			http.Hijacker
+			http.Pusher
+		}{w, h, p}
+	case flusher | hijacker | pusher:
+		return struct {
+			*limitWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{w, f, h, p}
+	case closeNotifier | pusher:
+		return struct {
+			*limitWriter
+			http.CloseNotifier
+			http.Pusher
+		}{w, c, p}
+	case flusher | closeNotifier | pusher:
+		return struct {
+			*limitWriter
+			http.Flusher
+			http.CloseNotifier
+			http.Pusher
+		}{w, f, c, p}
+	case hijacker | closeNotifier | pusher:
+		return struct {
+			*limitWriter
+			http.Hijacker
+			http.CloseNotifier
+			http.Pusher
+		}{w, h, c, p}
+	case flusher | hijacker | closeNotifier | pusher:
+		return struct {
+			*limitWriter
+			http.Flusher
+			http.Hijacker
+			http.CloseNotifier
+			http.Pusher
+		}{w, f, h, c, p}
+	case readerFrom | pusher:
+		return struct {
+			*limitWriter
+			io.ReaderFrom
+			http.Pusher
+		}{w, r, p}
+	case flusher | readerFrom | pusher:
+		return struct {
+			*limitWriter
+			http.Flusher
+			io.ReaderFrom
+			http.Pusher
+		}{w, f, r, p}
+	case hijacker | readerFrom | pusher:
+		return struct {
+			*limitWriter
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, h, r, p}
+	case flusher | hijacker | readerFrom | pusher:
+		return struct {
+			*limitWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, f, h, r, p}
+	case closeNotifier | readerFrom | pusher:
+		return struct {
+			*limitWriter
+			http.CloseNotifier
+			io.ReaderFrom
+			http.Pusher
+		}{w, c, r, p}
+	case flusher | closeNotifier | readerFrom | pusher:
+		return struct {
+			*limitWriter
+			http.Flusher
+			http.CloseNotifier
+			io.ReaderFrom
+			http.Pusher
+		}{w, f, c, r, p}
+	case hijacker | closeNotifier | readerFrom | pusher:
+		return struct {
+			*limitWriter
+			http.Hijacker
+			http.CloseNotifier
+			io.ReaderFrom
+			http.Pusher
+		}{w, h, c, r, p}
+	case flusher | hijacker | closeNotifier | readerFrom | pusher:
+		return struct {
+			*limitWriter
+			http.Flusher
+			http.Hijacker
+			http.CloseNotifier
+			io.ReaderFrom
+			http.Pusher
+		}{w, f, h, c, r, p}
+	}
+	return w
+}
+
+// limitReaderFrom implements io.ReaderFrom by the underlying writer's one,
+// so it keeps the sendfile fast path, ie. of http.ServeFile.
+type limitReaderFrom struct {
+	*limitWriter
+	io.ReaderFrom
+}
+
+// ReadFrom implements io.ReaderFrom interface. It copies a single chunk at
+// a time, once the tokens are taken. The tokens are taken for no more bytes
+// than src holds, if it's io.LimitedReader, ie. of io.CopyN.
+func (w *limitReaderFrom) ReadFrom(src io.Reader) (int64, error) {
+	lr, ok := src.(*io.LimitedReader)
+	if !ok {
+		lr = &io.LimitedReader{R: src, N: math.MaxInt64}
+	}
+
+	var total int64
+	for lr.N > 0 {
+		want := int64(w.chunk)
+		if want > lr.N {
+			want = lr.N
+		}
+		max, err := w.reserve(int(want))
+		if err != nil {
+			return total, err
+		}
+
+		// Don't wrap lr once again, the sendfile fast path only unwraps
+		// a single io.LimitedReader.
+		n, err := w.ReaderFrom.ReadFrom(&io.LimitedReader{R: lr.R, N: int64(max)})
+		w.release(int(n))
+		lr.N -= n
+		total += n
+		if err != nil || n < int64(max) {
+			return total, err
+		}
+	}
+	return total, nil
+}